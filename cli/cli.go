@@ -5,8 +5,12 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"nontrivialpursuit.org/deduptar/tarops"
 )
@@ -33,10 +37,22 @@ func fully_qualify_path(thepath *string) string {
 	return filepath.Join(cwd, specced_path)
 }
 
+func handle_interrupts() {
+	// So that interrupting deduptar doesn't leave partially written archives behind
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		received := <-interrupts
+		tarops.Interrupt()
+		fmt.Fprintf(os.Stderr, "Fatal: %v\n", received)
+		os.Exit(128 + int(received.(syscall.Signal)))
+	}()
+}
+
 func chatty(awaiter *sync.WaitGroup, progress *(chan tarops.ProgressMessage), verbose *bool) {
 	defer awaiter.Done()
 	for message := range *progress {
-		if *verbose && (message.Type == tarops.VerboseMessage) {
+		if (*verbose && message.Type == tarops.VerboseMessage) || message.Type == tarops.SummaryMessage {
 			fmt.Fprintln(os.Stdout, message.Message)
 		} else {
 			if message.Type == tarops.WarningMessage {
@@ -50,14 +66,57 @@ func RunCLI() {
 	verbose := flag.Bool("v", false, "Verbosely list files processed.")
 	follow_symlinks := flag.Bool("follow-symlinks", false, "Turn on the following of symlinks; archive the symlink destination rather than the symlink itself.")
 	no_recursion := flag.Bool("no-recursion", false, "Turn off recursing into directories.")
+	var excludes, exclude_froms stringList
+	flag.Var(&excludes, "exclude", "Leave out files matching this pattern (may be repeated).")
+	flag.Var(&exclude_froms, "exclude-from", "Leave out files matching the patterns listed in this file (may be repeated).")
+	anchored := flag.Bool("anchored", false, "Exclude patterns match from the start of the member name.")
+	no_anchored := flag.Bool("no-anchored", false, "Exclude patterns match after any '/' in the member name (default).")
+	newer := flag.String("newer", "", "Only archive files whose data or status changed after this date.")
+	newer_mtime := flag.String("newer-mtime", "", "Only archive files whose data changed after this date.")
+	one_file_system := flag.Bool("one-file-system", false, "Don't descend into directories on other filesystems.")
+	exclude_caches := flag.Bool("exclude-caches", false, "Leave out the contents of directories with a CACHEDIR.TAG, except for the tag itself.")
+	honor_nodump := flag.Bool("honor-nodump", false, "Leave out files with the nodump attribute.")
+	files_from := flag.String("T", "", "Archive the files listed in this file (- for stdin), in addition to those given as arguments.")
+	null := flag.Bool("null", false, "Lists read with -T and --exclude-from are NUL-separated.")
 	same_owner := flag.Bool("same-owner", false, "As in GNU Tar: upon extraction, set file ownership as recorded in the archive.")
-	freakout := flag.Bool("freakout", false, "Normally, upon encountering an error during extraction, deduptar will print a warning to stderr, and will continue operations. But with --freakout specified, it will exit immediately. In either case, the process exit code will be nonzero.")
+	freakout := flag.Bool("freakout", false, "Normally, upon encountering an error during extraction or archiving, deduptar will print a warning to stderr, and will continue operations. But with --freakout specified, it will exit immediately. In either case, the process exit code will be nonzero.")
 	version := flag.Bool("version", false, "Print version banner and exit.")
 	license := flag.Bool("license", false, "Print software license and exit.")
 	contributors := flag.Bool("contributors", false, "Print contributors and exit.")
 	src_archive := flag.String("x", "", "Tar file to extract from")
 	dst_archive := flag.String("c", "", "Tar file to create")
-	change_dir := flag.String("C", "", "Extract archive contents to DIR rather than to the current working directory.")
+	append_archive := flag.String("r", "", "Tar file to append to")
+	update_archive := flag.String("u", "", "Tar file to append changed files to")
+	concat_archive := flag.String("A", "", "Tar file to append other archives to")
+	delete_archive := flag.String("delete", "", "Tar file to delete members from")
+	replace_archive := flag.String("replace", "", "Tar file to replace members of")
+	edit_archive := flag.String("edit", "", "Tar file to edit member metadata of")
+	filter_archive := flag.String("filter", "", "Tar file to copy a selection of members from")
+	realign_archive := flag.String("realign", "", "Tar file to rewrite into the deduptar layout")
+	rename := flag.String("rename", "", "With --edit: new name for the member")
+	mode := flag.String("mode", "", "With --edit, or when archiving: new (octal) permissions for the members")
+	owner := flag.String("owner", "", "With --edit, or when archiving: new owner for the members")
+	group := flag.String("group", "", "With --edit, or when archiving: new group for the members")
+	mtime := flag.String("mtime", "", "With --edit, or when archiving: new modification time for the members")
+	clamp_mtime := flag.Bool("clamp-mtime", false, "When archiving: only set the modification time given with --mtime for files that are newer.")
+	numeric_owner := flag.Bool("numeric-owner", false, "When archiving: only record numeric user and group IDs, not names.")
+	sort_order := flag.String("sort", "name", "When archiving: the order of directory entries, 'name' or 'none'.")
+	no_atime_ctime := flag.Bool("no-atime-ctime", false, "When archiving: don't record access and status change times.")
+	change_dir := flag.String("C", "", "Extract archive contents to DIR, or archive files relative to DIR, rather than the current working directory.")
+	var transforms stringList
+	flag.Var(&transforms, "transform", "Rewrite member names with this sed expression (may be repeated).")
+	flag.Var(&transforms, "xform", "Same as --transform.")
+	xattrs := flag.Bool("xattrs", false, "Archive or restore extended attributes, including POSIX ACLs and file capabilities.")
+	var xattr_includes, xattr_excludes stringList
+	flag.Var(&xattr_includes, "xattrs-include", "With --xattrs: only consider extended attributes whose names match this pattern (may be repeated).")
+	flag.Var(&xattr_excludes, "xattrs-exclude", "With --xattrs: leave alone extended attributes whose names match this pattern (may be repeated).")
+	fflags := flag.Bool("fflags", false, "Archive or restore file flags (chattr attributes).")
+	absolute_names := flag.Bool("absolute-names", false, "Don't strip leading '/' and '..' components from member names.")
+	sparse := flag.Bool("sparse", false, "Store files with holes as sparse members.")
+	flag.BoolVar(sparse, "S", false, "Same as --sparse.")
+	align := flag.Int64("align", 0, "Align member data to multiples of this many bytes, rather than to the block size of the archive's filesystem.")
+	min_clone_size := flag.Int64("min-clone-size", 0, "Don't align the data of files smaller than this many bytes.")
+	layout := flag.String("layout", "aligned", "When archiving: 'aligned', or 'packed' to fill the padding in front of aligned members with small files.")
 	offset := flag.Uint("offset", 0, "Offset where the archve starts inside the input file.")
 
 	flag.Usage = func() {
@@ -66,13 +125,32 @@ func RunCLI() {
 
 Usage:
   Archiving:
-    deduptar [-v] -c archive.tar [--follow-symlinks] [--no-recursion] FILES...
+    deduptar [-v] -c archive.tar [--follow-symlinks] [--no-recursion] [-T LIST [--null]] [-C DIR] [--transform EXPR] [--absolute-names] [--sparse] [--align N] [--min-clone-size N] [--layout LAYOUT] [--freakout] [METADATA OPTIONS] [--fflags] [XATTR OPTIONS] [SELECTION OPTIONS] FILES...
+  Appending:
+    deduptar [-v] -r archive.tar [--follow-symlinks] [--no-recursion] [-T LIST [--null]] [-C DIR] [--transform EXPR] [--absolute-names] [--sparse] [--align N] [--min-clone-size N] [--layout LAYOUT] [--freakout] [METADATA OPTIONS] [--fflags] [XATTR OPTIONS] [SELECTION OPTIONS] FILES...
+    deduptar [-v] -u archive.tar [--follow-symlinks] [--no-recursion] [-T LIST [--null]] [-C DIR] [--transform EXPR] [--absolute-names] [--sparse] [--align N] [--min-clone-size N] [--layout LAYOUT] [--freakout] [METADATA OPTIONS] [--fflags] [XATTR OPTIONS] [SELECTION OPTIONS] FILES...
+  Concatenation:
+    deduptar [-v] -A archive.tar [--align N] [--min-clone-size N] ARCHIVES...
+  Deletion:
+    deduptar [-v] --delete archive.tar MEMBERS...
+  Replacement:
+    deduptar [-v] --replace archive.tar [--follow-symlinks] FILES...
+  Metadata editing:
+    deduptar [-v] --edit archive.tar [--rename NAME] [--mode MODE] [--owner USER] [--group GROUP] [--mtime DATE] MEMBERS...
+  Filtering:
+    deduptar [-v] --filter archive.tar [--align N] [--min-clone-size N] new_archive.tar [SELECTORS...]
+  Realignment:
+    deduptar [-v] --realign archive.tar [--align N] [--min-clone-size N] new_archive.tar
   Extraction:
-    deduptar [-v] -x archive.tar [-C DIR] [--same-owner] [--freakout]
+    deduptar [-v] -x archive.tar [-C DIR] [--same-owner] [--freakout] [--fflags] [XATTR OPTIONS]
 
   General options:
     -v
-      Verbosely list files processed to stdout.
+      Verbosely list files processed to stdout. Also reports how data gets from one filesystem
+      to another, which is found out once per pair of filesystems: by cloning where they
+      support it (btrfs, XFS), and by copying otherwise, with copy_file_range(2), or with
+      read(2) and write(2) where that can't be used either. So on filesystems without clone
+      support, deduptar works like any other tar.
     --version
       Print version banner and exit.
     --license
@@ -82,11 +160,215 @@ Usage:
 
   Archiving options:
     -c archive.tar
-      Tar file to create. Will be overwritten if it already exists.
+      Tar file to create. Will be overwritten if it already exists, but only once the new
+      archive is complete; until then, it's an unnamed (O_TMPFILE) or hidden file in the same
+      directory. If archiving fails or is interrupted, the existing file is left alone. If
+      archive.tar is a symlink, the file it points to is replaced, keeping its permissions.
+    -r archive.tar
+      Tar file to append to. It must have been created before, with deduptar or any other tar.
+      If appending fails or is interrupted, the archive is restored to what it was.
+    -u archive.tar
+      Like -r, but only append files whose modification time or size differs from that of
+      their last copy in the archive. That's the files' own modification time, whatever
+      --mtime would set it to in the archive. SOURCE_DATE_EPOCH doesn't apply to -u, as
+      every file newer than it would be appended again every time.
     --follow-symlinks
       Resolve symlinks; this archives the symlink destination rather than the symlink itself.
     --no-recursion
       Turn off recursing into directories.
+    -T LIST
+      Archive the files listed in the file LIST, one per line, after the FILES given as
+      arguments. If LIST is -, the list is read from stdin.
+    --null
+      The lists read with -T and --exclude-from are NUL-separated rather than newline-separated,
+      as produced by 'find -print0'.
+    -C DIR
+      Take relative FILES (and the files listed with -T) relative to DIR rather than to the
+      current working directory. They are still named as given in the archive.
+    --transform EXPR, --xform EXPR
+      Rewrite archive names with the sed-style substitution EXPR: s/REGEX/REPLACEMENT/[FLAGS],
+      where REGEX is a POSIX basic regular expression, and in REPLACEMENT, & stands for the
+      match and \1 to \9 for its groups. Any character can be used instead of the '/'.
+      FLAGS are: g to replace all matches, N to replace the Nth match (and those after it,
+      with g), i to ignore case, x for an extended regular expression, and R and S to leave
+      archive names, or symlink targets, alone. Several expressions can be separated with ';',
+      or given with --transform more than once; they apply one after the other. Hardlinks
+      always refer to the name their target was archived under.
+    --absolute-names
+      Keep leading '/'s and '..' components in archive names. By default, they are stripped
+      (with a warning), so that extracting the archive can't write outside of the extraction
+      directory: '/etc/hosts' is archived as 'etc/hosts', and 'a/../../b' as 'b'.
+    --sparse, -S
+      Store files with holes as sparse members, in the PAX 1.0 sparse format of GNU tar, so
+      that the holes take up no room in the archive. The data of such members is aligned
+      too, and cloned in whole blocks. Upon extraction, sparse members (in any of GNU tar's
+      sparse formats) are always restored with holes.
+    --freakout
+      Normally, files that can't be archived (such as unreadable files, and files that were
+      removed in the meantime, and sockets) are skipped with a warning, and the process exit
+      code will be nonzero at the end. With --freakout, deduptar exits immediately instead; the
+      archive is then left as it was, or not created at all.
+    --align N
+      Align member data to multiples of N bytes, which must be a multiple of 512, up to 65536.
+      By default, it's the block size of the filesystem the archive is on (as reported by
+      statfs(2)), or the page size (4096) if that's smaller; appending to an archive made by
+      deduptar keeps to its alignment. Filesystems clone data in whole blocks, so member data
+      can only be cloned, into the archive and out of it, when N is a multiple of the block
+      size. The alignment is recorded in a PAX global header at the start of the archive
+      (DEDUPTAR.alignment), which deduptar skips upon extraction. Also valid for -A, --filter
+      and --realign.
+    --min-clone-size N
+      Store the data of files smaller than N bytes unaligned, and copy it rather than clone
+      it. Aligning member data takes up to a block of padding per member (see --align),
+      which isn't worth it for small files. Even without this option, files that are smaller
+      than the padding they would need are stored unaligned. Also valid for -A, --filter and
+      --realign. Whatever the layout, writing an archive ends with a summary on stdout of how
+      many bytes of padding aligning member data took, and how many bytes were cloned.
+    --layout LAYOUT
+      'aligned' (the default) archives files in the order they're found in. 'packed' holds
+      back files smaller than the minimum clone size (64 KiB, unless given with
+      --min-clone-size), and writes them in front of aligned members, where there would be
+      padding otherwise, but only in front of members in the same directory. What's left
+      of them is written back to back before the archive moves on past that directory.
+      Empty files aren't held back. A directory is still archived before the files in it,
+      and a file with several links before its hardlinks.
+
+  Metadata options (for archiving and appending):
+    --mode MODE, --owner USER, --group GROUP, --mtime DATE
+      Record these for all files, instead of their own; see "Metadata editing options".
+    --clamp-mtime
+      Only record the --mtime DATE for files that were modified later than that.
+    --numeric-owner
+      Only record numeric user and group IDs, not user and group names.
+    --sort ORDER
+      The order in which to archive the entries of directories: 'name' (the default) sorts
+      them by name, 'none' takes them in the order the filesystem lists them.
+    --no-atime-ctime
+      Don't record access and status change times. These would otherwise be recorded in the
+      PAX records of every member, and be different every time.
+    If the SOURCE_DATE_EPOCH environment variable is set (see
+    https://reproducible-builds.org/specs/source-date-epoch/), and --mtime isn't given, it
+    acts as --mtime @SOURCE_DATE_EPOCH --clamp-mtime, except with -u. So with --numeric-owner and
+    --no-atime-ctime, archiving identical trees yields identical archives.
+    --fflags
+      Archive the file flags of regular files and directories, as set with chattr(1), or
+      restore them upon extraction. They're stored in a SCHILY.fflags PAX record, with the
+      names BSD tar uses: sappnd (+a), schg (+i), nodump (+d), compress (+c), noatime (+A),
+      nocow (+C), sync (+S), dirsync (+D), journal-data (+j), secdel (+s), uunlink (+u),
+      notail (+t), topdir (+T) and projinherit (+P). Upon extraction, nocow and compress are
+      set before any data is written; the other flags after all other metadata. Flags of
+      directories, and schg and sappnd (which would keep hardlinks to a file from being
+      extracted), are set once extraction is done. Setting schg and sappnd requires
+      privileges.
+      Files with the nocow flag can't be cloned, only copied. Nor can files that inherit it from
+      the directory they're extracted into, which is warned about once per directory.
+
+  Extended attribute options (for archiving, appending and extraction):
+    --xattrs
+      Archive extended attributes, or restore them upon extraction. They're stored as
+      SCHILY.xattr PAX records, like GNU tar and BSD tar do. POSIX ACLs and file capabilities
+      are extended attributes too (system.posix_acl_access, system.posix_acl_default and
+      security.capability). Upon extraction, capabilities are restored after the ownership,
+      as changing ownership clears them. Failing to restore an attribute is warned about.
+    --xattrs-include PATTERN
+      Only consider extended attributes whose names match the shell-style PATTERN, such as
+      'user.*'. May be given more than once.
+    --xattrs-exclude PATTERN
+      Leave alone extended attributes whose names match the shell-style PATTERN. May be given
+      more than once.
+
+  Selection options (for archiving and appending):
+    --exclude PATTERN
+      Leave out files whose archive name, or one of its leading directories, matches the
+      shell-style PATTERN, such as '*.o' or '[[:digit:]]*'. Wildcards match '/' as well. May be
+      given more than once.
+    --exclude-from FILE
+      Leave out files matching any of the patterns in FILE, one per line. May be given more
+      than once.
+    --anchored
+      Exclude patterns must match from the start of the archive name.
+    --no-anchored
+      Exclude patterns may match starting after any '/' in the archive name. This is the default.
+    --newer DATE
+      Only archive files whose data or status changed at or after DATE. Directories are
+      archived regardless. For the format of DATE, see --mtime.
+    --newer-mtime DATE
+      Like --newer, but only considers the modification time of the data.
+    --one-file-system
+      Don't descend into directories that are on another filesystem than the FILES argument
+      they were found under. The directories themselves are still archived.
+    --exclude-caches
+      Leave out the contents of directories with a CACHEDIR.TAG file (see
+      https://bford.info/cachedir/), except for the CACHEDIR.TAG file itself.
+    --honor-nodump
+      Leave out files and directories with the nodump attribute set (see chattr(1)).
+
+  Concatenation options:
+    -A archive.tar
+      Tar file to append the members of the other archives to; it is created if it doesn't exist.
+      Member data is cloned out of the other archives where it is aligned, which it is
+      for archives created by deduptar. Other members are copied, but still aligned
+      in archive.tar (see --align). If concatenating fails or is interrupted, archive.tar is
+      restored to what it was.
+
+  Deletion options:
+    --delete archive.tar
+      Tar file to delete the named members from, in place. Naming a directory deletes its
+      contents as well. Where the layout allows, the space of the deleted members is cut out
+      of the file with fallocate(FALLOC_FL_COLLAPSE_RANGE), and otherwise the archive is
+      rewritten, cloning the remaining members from the original. Members at the end of
+      the archive are moved down in place only if there's no more than 16 MiB of them. When
+      a deleted member has hardlinks that aren't deleted, the first of those gets to hold
+      the data instead, in a rewritten archive. With -v, the strategy used is listed for
+      every member deleted.
+
+  Replacement options:
+    --replace archive.tar
+      Tar file in which to replace the members named like FILES with the current FILES, in
+      place. Directories are not recursed into. FILES that aren't in the archive yet are
+      appended. Where the layout allows, room for a new member is made with
+      fallocate(FALLOC_FL_INSERT_RANGE) or fallocate(FALLOC_FL_COLLAPSE_RANGE), and otherwise
+      the archive is rewritten, cloning the other members from the original. With -v, the
+      strategy used is listed for every member replaced. If replacing fails or is interrupted,
+      the archive is restored to what it was.
+
+  Metadata editing options:
+    --edit archive.tar
+      Tar file in which to change the metadata of the named members, in place. Naming a
+      directory edits its contents as well. Only the headers are rewritten, making use of the
+      room that deduptar's header padding provides; if an edited header doesn't fit, nothing
+      is changed.
+    --rename NAME
+      Rename the member (only one may be named) to NAME. Members inside a renamed directory,
+      and hardlinks to renamed members, are renamed along.
+    --mode MODE
+      Set the permissions to MODE, in octal.
+    --owner USER
+      Set the owner to USER, which is a user name, a numeric ID, or NAME:ID.
+    --group GROUP
+      Set the group to GROUP, which is a group name, a numeric ID, or NAME:ID.
+    --mtime DATE
+      Set the modification time to DATE, which is YYYY-MM-DD[ HH:MM[:SS]], an RFC 3339
+      timestamp, @SECONDS_SINCE_EPOCH, or the path of a file (starting with '/' or '.')
+      whose modification time is to be used.
+
+  Filtering options:
+    --filter archive.tar
+      Tar file to copy members from into new_archive.tar, which will be overwritten if it
+      already exists. Aligned member data is cloned, other member data is copied (and
+      aligned in new_archive.tar, see --align). Without SELECTORS, all members are copied.
+    SELECTORS
+      A selector is a PATTERN or PATTERN=NAME. Members are selected if the shell-style PATTERN
+      matches their name, or one of their leading directories. With =NAME, the matching part
+      of the name of the selected member is replaced by NAME. Hardlinks whose target isn't
+      selected are stored as regular files.
+
+  Realignment options:
+    --realign archive.tar
+      Tar file, made by any tar, to rewrite into new_archive.tar with deduptar's layout, so
+      that its member data will be cloned upon extraction. Member data that is aligned
+      already is cloned, other member data is copied. new_archive.tar will be overwritten if
+      it already exists. If archive.tar is -, the archive is read from stdin.
 
   Extraction options:
     -x archive.tar
@@ -115,49 +397,229 @@ Usage:
 	case *contributors:
 		fmt.Print(contributors)
 	default:
-		dst_archive_is_specced, src_archive_is_specced, change_dir_is_specced := len(*dst_archive) > 0, len(*src_archive) > 0, len(*change_dir) > 0
+		dst_archive_is_specced, src_archive_is_specced, append_archive_is_specced, update_archive_is_specced, concat_archive_is_specced, delete_archive_is_specced, replace_archive_is_specced, edit_archive_is_specced, filter_archive_is_specced, realign_archive_is_specced := len(*dst_archive) > 0, len(*src_archive) > 0, len(*append_archive) > 0, len(*update_archive) > 0, len(*concat_archive) > 0, len(*delete_archive) > 0, len(*replace_archive) > 0, len(*edit_archive) > 0, len(*filter_archive) > 0, len(*realign_archive) > 0
+		change_dir_is_specced := len(*change_dir) > 0
+		is_archiving := dst_archive_is_specced || append_archive_is_specced || update_archive_is_specced
+		if source_date_epoch, is_set := os.LookupEnv("SOURCE_DATE_EPOCH"); is_set && (dst_archive_is_specced || append_archive_is_specced) && len(*mtime) == 0 {
+			// See https://reproducible-builds.org/specs/source-date-epoch/. Not for -u, which compares the files' own
+			// modification times with the archived ones, and would take every clamped file for a changed one.
+			*mtime = "@" + source_date_epoch
+			*clamp_mtime = true
+		}
 		archive_progress := make(chan tarops.ProgressMessage)
 		awaiter := new(sync.WaitGroup)
 		awaiter.Add(1)
 		go chatty(awaiter, &archive_progress, verbose)
+		handle_interrupts()
 
-		if !(dst_archive_is_specced || src_archive_is_specced) {
-			halp("Fatal: Neither an archive to extract from, nor an archive to create have been specified.")
-		} else if dst_archive_is_specced && src_archive_is_specced {
-			halp("Fatal: Both an archive to extract from, and an archive to create have been specified.")
-		} else if dst_archive_is_specced {
-			if change_dir_is_specced {
-				halp("Fatal: -C is only valid in combination with -x (extract).")
+		operations_specced := 0
+		for _, is_specced := range []bool{dst_archive_is_specced, src_archive_is_specced, append_archive_is_specced, update_archive_is_specced, concat_archive_is_specced, delete_archive_is_specced, replace_archive_is_specced, edit_archive_is_specced, filter_archive_is_specced, realign_archive_is_specced} {
+			if is_specced {
+				operations_specced++
+			}
+		}
+		if operations_specced == 0 {
+			halp("Fatal: Neither an archive to extract from, nor an archive to create or modify have been specified.")
+		} else if operations_specced > 1 {
+			halp("Fatal: Only one of -c (create), -r (append), -u (update), -A (concatenate), --delete, --replace, --edit, --filter, --realign and -x (extract) may be specified.")
+		} else if !edit_archive_is_specced && len(*rename) > 0 {
+			halp("Fatal: --rename is only valid in combination with --edit.")
+		} else if !(edit_archive_is_specced || is_archiving) && len(*mode+*owner+*group+*mtime) > 0 {
+			halp("Fatal: --mode, --owner, --group and --mtime are only valid in combination with --edit, -c (create), -r (append) or -u (update).")
+		} else if *clamp_mtime && len(*mtime) == 0 {
+			halp("Fatal: --clamp-mtime requires --mtime.")
+		} else if *sort_order != "name" && *sort_order != "none" {
+			halp(fmt.Sprintf("Fatal: invalid --sort order: '%s'", *sort_order))
+		} else if *layout != "aligned" && *layout != "packed" {
+			halp(fmt.Sprintf("Fatal: invalid --layout: '%s'", *layout))
+		} else if !is_archiving && (*clamp_mtime || *numeric_owner || *sort_order != "name" || *layout != "aligned" || *no_atime_ctime || len(transforms) > 0 || *absolute_names || *sparse || len(excludes) > 0 || len(exclude_froms) > 0 || *anchored || *no_anchored || len(*newer+*newer_mtime) > 0 || *one_file_system || *exclude_caches || *honor_nodump || len(*files_from) > 0 || *null) {
+			halp("Fatal: -T, --null, --transform, --absolute-names, --sparse, --clamp-mtime, --numeric-owner, --sort, --layout, --no-atime-ctime, --exclude, --exclude-from, --anchored, --no-anchored, --newer, --newer-mtime, --one-file-system, --exclude-caches and --honor-nodump are only valid in combination with -c (create), -r (append) or -u (update).")
+		} else if *anchored && *no_anchored {
+			halp("Fatal: Only one of --anchored and --no-anchored may be specified.")
+		} else if !(is_archiving || src_archive_is_specced) && (*xattrs || *fflags) {
+			halp("Fatal: --xattrs and --fflags are only valid in combination with -x (extract), -c (create), -r (append) or -u (update).")
+		} else if !*xattrs && len(xattr_includes)+len(xattr_excludes) > 0 {
+			halp("Fatal: --xattrs-include and --xattrs-exclude are only valid in combination with --xattrs.")
+		} else if src_archive_is_specced {
+			extract_options := &tarops.ExtractOptions{
+				SameOwner:    *same_owner,
+				Freakout:     *freakout,
+				Fflags:       *fflags,
+				XattrOptions: tarops.XattrOptions{Xattrs: *xattrs, XattrIncludes: xattr_includes, XattrExcludes: xattr_excludes},
+			}
+			extract(src_archive, change_dir, extract_options, offset, &archive_progress, awaiter)
+		} else {
+			if change_dir_is_specced && !is_archiving {
+				halp("Fatal: -C is only valid in combination with -x (extract), -c (create), -r (append) or -u (update).")
 			}
 			if *same_owner {
 				halp("Fatal: --same-owner is only valid in combination with -x (extract).")
 			}
-			if *freakout {
-				halp("Fatal: --freakout is only valid in combination with -x (extract).")
+			if *freakout && !is_archiving {
+				halp("Fatal: --freakout is only valid in combination with -x (extract), -c (create), -r (append) or -u (update).")
 			}
-			abort_err := tarops.Archive(dst_archive, flag.Args(), follow_symlinks, no_recursion, &archive_progress)
-			close(archive_progress)
-			awaiter.Wait()
-			if abort_err != nil {
-				seppuku(abort_err)
+			if (*align != 0 || *min_clone_size != 0) && !(is_archiving || concat_archive_is_specced || filter_archive_is_specced || realign_archive_is_specced) {
+				halp("Fatal: --align and --min-clone-size are only valid in combination with -c (create), -r (append), -u (update), -A (concatenate), --filter or --realign.")
 			}
-		} else if src_archive_is_specced {
-			tarfile, err := os.Open(*src_archive)
-			if err != nil {
-				seppuku(err)
+			layout_options := &tarops.LayoutOptions{Alignment: *align, MinCloneSize: *min_clone_size}
+			allgood := true
+			var abort_err error
+			var archive_options *tarops.ArchiveOptions
+			if is_archiving {
+				archive_options = make_archive_options(follow_symlinks, no_recursion, excludes, exclude_froms, null, anchored, newer, newer_mtime, one_file_system, exclude_caches, honor_nodump, change_dir, transforms, absolute_names, make_edit(rename, mode, owner, group, mtime), clamp_mtime, numeric_owner, sort_order, no_atime_ctime, sparse, fflags, xattrs, xattr_includes, xattr_excludes, freakout, layout, layout_options)
+			}
+			if dst_archive_is_specced {
+				allgood, abort_err = tarops.Archive(dst_archive, archive_inpaths(files_from, null), archive_options, &archive_progress)
+			} else if append_archive_is_specced {
+				allgood, abort_err = tarops.Append(append_archive, archive_inpaths(files_from, null), archive_options, &archive_progress)
+			} else if update_archive_is_specced {
+				allgood, abort_err = tarops.Update(update_archive, archive_inpaths(files_from, null), archive_options, &archive_progress)
+			} else if concat_archive_is_specced {
+				abort_err = tarops.Concatenate(concat_archive, flag.Args(), layout_options, &archive_progress)
+			} else if delete_archive_is_specced {
+				allgood, abort_err = tarops.Delete(delete_archive, flag.Args(), &archive_progress)
+			} else if replace_archive_is_specced {
+				abort_err = tarops.Replace(replace_archive, flag.Args(), follow_symlinks, &archive_progress)
+			} else if filter_archive_is_specced {
+				if flag.NArg() < 1 {
+					halp("Fatal: --filter requires an archive to create.")
+				}
+				filtered_archive := flag.Arg(0)
+				allgood, abort_err = tarops.Filter(filter_archive, &filtered_archive, flag.Args()[1:], layout_options, &archive_progress)
+			} else if realign_archive_is_specced {
+				if flag.NArg() != 1 {
+					halp("Fatal: --realign requires exactly one archive to create.")
+				}
+				realigned_archive := flag.Arg(0)
+				allgood, abort_err = tarops.Realign(realign_archive, &realigned_archive, layout_options, &archive_progress)
+			} else {
+				allgood, abort_err = tarops.Edit(edit_archive, flag.Args(), make_edit(rename, mode, owner, group, mtime), &archive_progress)
 			}
-			defer tarfile.Close()
-			allgood, abort_err := tarops.Extract(fully_qualify_path(change_dir), tarfile, same_owner, freakout, &archive_progress, *offset)
 			close(archive_progress)
 			awaiter.Wait()
 			if abort_err != nil {
 				seppuku(abort_err)
-			} else {
-				if !allgood {
-					fmt.Fprintln(os.Stderr, "Warning: One or more errors were encountered, and ignored.")
-					os.Exit(1)
-				}
+			} else if !allgood {
+				fmt.Fprintln(os.Stderr, "Warning: One or more errors were encountered, and ignored.")
+				os.Exit(1)
 			}
 		}
 	}
 }
+
+func make_edit(rename *string, mode *string, owner *string, group *string, mtime *string) (edit *tarops.MemberEdit) {
+	edit = new(tarops.MemberEdit)
+	if len(*rename) > 0 {
+		if flag.NArg() != 1 {
+			halp("Fatal: --rename requires exactly one member to be named.")
+		}
+		edit.Name = rename
+	}
+	if len(*mode) > 0 {
+		parsed_mode, err := strconv.ParseInt(*mode, 8, 64)
+		if err != nil || parsed_mode < 0 || parsed_mode > 0o7777 {
+			halp(fmt.Sprintf("Fatal: invalid mode: '%s'", *mode))
+		}
+		edit.Mode = &parsed_mode
+	}
+	if len(*owner) > 0 {
+		uid, uname, err := parse_user(*owner)
+		if err != nil {
+			halp(fmt.Sprintf("Fatal: invalid owner '%s': %v", *owner, err))
+		}
+		edit.Uid, edit.Uname = &uid, &uname
+	}
+	if len(*group) > 0 {
+		gid, gname, err := parse_group(*group)
+		if err != nil {
+			halp(fmt.Sprintf("Fatal: invalid group '%s': %v", *group, err))
+		}
+		edit.Gid, edit.Gname = &gid, &gname
+	}
+	if len(*mtime) > 0 {
+		parsed_mtime, err := parse_date(*mtime)
+		if err != nil {
+			halp(fmt.Sprintf("Fatal: %v", err))
+		}
+		edit.ModTime = &parsed_mtime
+	}
+	return
+}
+
+func make_archive_options(follow_symlinks *bool, no_recursion *bool, excludes stringList, exclude_froms stringList, null *bool, anchored *bool, newer *string, newer_mtime *string, one_file_system *bool, exclude_caches *bool, honor_nodump *bool, change_dir *string, transforms stringList, absolute_names *bool, overrides *tarops.MemberEdit, clamp_mtime *bool, numeric_owner *bool, sort_order *string, no_atime_ctime *bool, sparse *bool, fflags *bool, xattrs *bool, xattr_includes stringList, xattr_excludes stringList, freakout *bool, layout *string, layout_options *tarops.LayoutOptions) (options *tarops.ArchiveOptions) {
+	options = &tarops.ArchiveOptions{
+		FollowSymlinks: *follow_symlinks,
+		NoRecursion:    *no_recursion,
+		Excludes:       excludes,
+		Anchored:       *anchored,
+		OneFileSystem:  *one_file_system,
+		ExcludeCaches:  *exclude_caches,
+		HonorNodump:    *honor_nodump,
+		Directory:      *change_dir,
+		Transforms:     transforms,
+		AbsoluteNames:  *absolute_names,
+		Overrides:      overrides,
+		ClampMtime:     *clamp_mtime,
+		NumericOwner:   *numeric_owner,
+		DirectoryOrder: *sort_order == "none",
+		NoAtimeCtime:   *no_atime_ctime,
+		Sparse:         *sparse,
+		Freakout:       *freakout,
+		Packed:         *layout == "packed",
+		LayoutOptions:  *layout_options,
+		Fflags:         *fflags,
+		XattrOptions:   tarops.XattrOptions{Xattrs: *xattrs, XattrIncludes: xattr_includes, XattrExcludes: xattr_excludes},
+	}
+	for _, exclude_from := range exclude_froms {
+		patterns, err := read_list(exclude_from, *null)
+		if err != nil {
+			seppuku(err)
+		}
+		options.Excludes = append(options.Excludes, patterns...)
+	}
+	options.Newer = parse_date_option(newer)
+	options.NewerMtime = parse_date_option(newer_mtime)
+	return
+}
+
+func archive_inpaths(files_from *string, null *bool) (inpaths []string) {
+	inpaths = flag.Args()
+	if len(*files_from) > 0 {
+		listed, err := read_list(*files_from, *null)
+		if err != nil {
+			seppuku(err)
+		}
+		inpaths = append(inpaths, listed...)
+	}
+	return
+}
+
+func parse_date_option(spec *string) *time.Time {
+	if len(*spec) == 0 {
+		return nil
+	}
+	parsed_date, err := parse_date(*spec)
+	if err != nil {
+		halp(fmt.Sprintf("Fatal: %v", err))
+	}
+	return &parsed_date
+}
+
+func extract(src_archive *string, change_dir *string, options *tarops.ExtractOptions, offset *uint, archive_progress *(chan tarops.ProgressMessage), awaiter *sync.WaitGroup) {
+	tarfile, err := os.Open(*src_archive)
+	if err != nil {
+		seppuku(err)
+	}
+	defer tarfile.Close()
+	allgood, abort_err := tarops.Extract(fully_qualify_path(change_dir), tarfile, options, archive_progress, *offset)
+	close(*archive_progress)
+	awaiter.Wait()
+	if abort_err != nil {
+		seppuku(abort_err)
+	} else {
+		if !allgood {
+			fmt.Fprintln(os.Stderr, "Warning: One or more errors were encountered, and ignored.")
+			os.Exit(1)
+		}
+	}
+}
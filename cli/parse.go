@@ -0,0 +1,137 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+func read_list(listfile string, null_separated bool) (entries []string, err error) {
+	// Reads entries from a file (or stdin, for "-"), one per line, or NUL-separated. Empty entries are skipped.
+	var contents []byte
+	if listfile == "-" {
+		contents, err = io.ReadAll(os.Stdin)
+	} else {
+		contents, err = os.ReadFile(listfile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	separator := "\n"
+	if null_separated {
+		separator = "\x00"
+	}
+	for _, entry := range strings.Split(string(contents), separator) {
+		if !null_separated {
+			entry = strings.TrimSuffix(entry, "\r")
+		}
+		if len(entry) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+var date_layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parse_date(spec string) (time.Time, error) {
+	// As in GNU tar, a DATE starting with '/' or '.' names a file whose modification time is to be used.
+	if strings.HasPrefix(spec, "/") || strings.HasPrefix(spec, ".") {
+		finfo, err := os.Stat(spec)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return finfo.ModTime(), nil
+	}
+	if epoch_spec, is_epoch := strings.CutPrefix(spec, "@"); is_epoch {
+		seconds, err := strconv.ParseInt(epoch_spec, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date: '%s'", spec)
+		}
+		return time.Unix(seconds, 0), nil
+	}
+	for _, layout := range date_layouts {
+		if parsed, err := time.ParseInLocation(layout, spec, time.Local); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date: '%s' (use YYYY-MM-DD[ HH:MM[:SS]], RFC 3339, @SECONDS_SINCE_EPOCH, or a path to a file)", spec)
+}
+
+func parse_owner(spec string, lookup_by_name func(string) (string, error), lookup_by_id func(string) (string, error)) (id int, name string, err error) {
+	// NAME, ID, or NAME:ID, like GNU tar's --owner and --group.
+	if named, numbered, has_both := strings.Cut(spec, ":"); has_both {
+		if id, err = strconv.Atoi(numbered); err != nil {
+			return 0, "", fmt.Errorf("invalid ID in '%s'", spec)
+		}
+		return id, named, nil
+	}
+	if id, err = strconv.Atoi(spec); err == nil {
+		name, _ = lookup_by_id(spec)
+		return id, name, nil
+	}
+	numbered, err := lookup_by_name(spec)
+	if err != nil {
+		return 0, "", err
+	}
+	id, err = strconv.Atoi(numbered)
+	return id, spec, err
+}
+
+func parse_user(spec string) (uid int, uname string, err error) {
+	return parse_owner(spec,
+		func(name string) (string, error) {
+			found, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return found.Uid, nil
+		},
+		func(id string) (string, error) {
+			found, err := user.LookupId(id)
+			if err != nil {
+				return "", err
+			}
+			return found.Username, nil
+		})
+}
+
+func parse_group(spec string) (gid int, gname string, err error) {
+	return parse_owner(spec,
+		func(name string) (string, error) {
+			found, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return found.Gid, nil
+		},
+		func(id string) (string, error) {
+			found, err := user.LookupGroupId(id)
+			if err != nil {
+				return "", err
+			}
+			return found.Name, nil
+		})
+}
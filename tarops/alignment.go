@@ -0,0 +1,133 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Records the alignment in the PAX global header at the start of archives made by deduptar
+	pax_alignment_key = "DEDUPTAR.alignment"
+	// No filesystem clones in larger blocks than this; network filesystems may well report larger ones, which are
+	// just what they transfer data in.
+	max_alignment = 64 * 1024
+	// With the packed layout, files smaller than this aren't aligned, unless asked otherwise
+	packed_min_clone_size = 64 * 1024
+	// How many small files the packed layout holds back at most, before writing them all back to back
+	max_held_back_files = 4096
+	max_held_back_size  = 64 * 1024 * 1024
+)
+
+type LayoutOptions struct {
+	Alignment    int64 // if not 0, align member bodies to multiples of this many bytes, rather than detecting what suits the archive
+	MinCloneSize int64 // files smaller than this are stored unaligned, as cloning them wouldn't be worth the padding
+}
+
+type archiveLayout struct {
+	// How member bodies are laid out in the archive being written
+	alignment      int64 // member bodies start at multiples of this
+	block_size     int64 // the granularity at which the archive's filesystem clones data
+	min_clone_size int64 // smaller bodies aren't aligned
+	// What the layout has cost and brought so far
+	padding_bytes int64
+	cloned_bytes  int64
+}
+
+func fs_block_size(file *os.File) int64 {
+	// FICLONERANGE takes offsets and lengths in whole filesystem blocks, which statfs() reports.
+	var fs_stat unix.Statfs_t
+	if unix.Fstatfs(int(file.Fd()), &fs_stat) != nil {
+		return FS_PAGESIZE
+	}
+	block_size := int64(fs_stat.Bsize)
+	if block_size < TAR_BLOCKSIZE || block_size > max_alignment || block_size&(block_size-1) != 0 {
+		return FS_PAGESIZE
+	}
+	return block_size
+}
+
+func validate_alignment(alignment int64) error {
+	if alignment <= 0 || alignment%TAR_BLOCKSIZE != 0 || alignment > max_alignment {
+		return fmt.Errorf("invalid alignment %d: must be a multiple of %d, up to %d", alignment, TAR_BLOCKSIZE, max_alignment)
+	}
+	return nil
+}
+
+func recorded_alignment(tarfile *os.File, start_offset int64) (alignment int64, is_recorded bool) {
+	// The alignment in the global header the archive starts with, if it was made by deduptar.
+	header, next_err := tar.NewReader(io.NewSectionReader(tarfile, start_offset, math.MaxInt64-start_offset)).Next()
+	if next_err != nil || header.Typeflag != tar.TypeXGlobalHeader {
+		return 0, false
+	}
+	alignment, parse_err := strconv.ParseInt(header.PAXRecords[pax_alignment_key], 10, 64)
+	if parse_err != nil || validate_alignment(alignment) != nil {
+		return 0, false
+	}
+	return alignment, true
+}
+
+func archive_layout(tarfile *os.File, options *LayoutOptions) (layout *archiveLayout, abort_err error) {
+	// An alignment asked for goes first, then the one the archive was laid out with already. Otherwise it's the block
+	// size of the archive's filesystem, though no less than a page, so that the archive still clones out when it's
+	// copied to a filesystem with the usual block size. Without options, the archive's own layout is kept to.
+	if options == nil {
+		options = &LayoutOptions{}
+	}
+	layout = &archiveLayout{block_size: fs_block_size(tarfile), min_clone_size: options.MinCloneSize}
+	if options.MinCloneSize < 0 {
+		return nil, errorDuringOp{Path: tarfile.Name(), Op: "laying out", Err: fmt.Errorf("invalid minimum clone size %d", options.MinCloneSize)}
+	}
+	if options.Alignment != 0 {
+		if abort_err = validate_alignment(options.Alignment); abort_err != nil {
+			return nil, errorDuringOp{Path: tarfile.Name(), Op: "laying out", Err: abort_err}
+		}
+		layout.alignment = options.Alignment
+	} else if alignment, is_recorded := recorded_alignment(tarfile, 0); is_recorded {
+		layout.alignment = alignment
+	} else {
+		layout.alignment = max(layout.block_size, FS_PAGESIZE)
+	}
+	return
+}
+
+func worth_aligning(layout *archiveLayout, header_growth int, body_size int64) bool {
+	// Padding a header costs header_growth bytes. That's not worth it for bodies smaller than that, nor for bodies
+	// smaller than the minimum clone size.
+	return int64(header_growth) <= body_size && body_size >= layout.min_clone_size
+}
+
+func report_layout(layout *archiveLayout, archive_progress *(chan ProgressMessage)) {
+	summary_message(archive_progress, fmt.Sprintf("Layout: %d bytes of padding spent, %d bytes cloned", layout.padding_bytes, layout.cloned_bytes))
+}
+
+func is_layout_header(header *tar.Header) bool {
+	// The global header deduptar starts its archives with. It describes just that archive, so it isn't carried over
+	// into others.
+	_, is_layout := header.PAXRecords[pax_alignment_key]
+	return header.Typeflag == tar.TypeXGlobalHeader && is_layout
+}
+
+func write_layout_header(tarfile *os.File, layout *archiveLayout) error {
+	header := &tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "pax_global_header",
+		PAXRecords: map[string]string{pax_alignment_key: strconv.FormatInt(layout.alignment, 10)},
+		Format:     tar.FormatPAX,
+	}
+	tar_writer := tar.NewWriter(tarfile)
+	if err := tar_writer.WriteHeader(header); err != nil {
+		return errorDuringOp{Path: tarfile.Name(), Op: "WriteHeader", Err: err}
+	}
+	// Pads the records out to a tar block
+	if err := tar_writer.Flush(); err != nil {
+		return errorDuringOp{Path: tarfile.Name(), Op: "writing", Err: err}
+	}
+	return nil
+}
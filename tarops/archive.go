@@ -13,119 +13,307 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-func ficlone_into_archive(srcfile *os.File, archive *os.File, header *tar.Header) error {
-	pos := tell(archive)
-	ficlonerange := unix.FileCloneRange{
-		Src_fd:      int64(srcfile.Fd()),
-		Src_offset:  0,
-		Src_length:  0,
-		Dest_offset: uint64(pos),
-	}
-	if clone_err := unix.IoctlFileCloneRange(int(archive.Fd()), &ficlonerange); clone_err != nil {
-		return clone_err
-	} else {
-		newpos, _ := archive.Seek(0, io.SeekEnd)
-		if written := newpos - pos; written != header.Size {
-			return fmt.Errorf(error_writesize, "reading", header.Name, written, header.Size)
+func available_body(srcfile *os.File, src_offset int64, header *tar.Header) (available int64, src_size int64, abort_err error) {
+	// How much of the body the source still has; a file may have shrunk since its header was made.
+	var src_stat unix.Stat_t
+	if abort_err = unix.Fstat(int(srcfile.Fd()), &src_stat); abort_err != nil {
+		return 0, 0, sourceError{errorDuringOp{Path: srcfile.Name(), Op: "fstat()", Err: abort_err}}
+	}
+	return min(header.Size, max(src_stat.Size-src_offset, 0)), src_stat.Size, nil
+}
+
+func zerofill_body(tarfile *os.File, body_offset int64, available int64, header *tar.Header) error {
+	// Pads the body of a file that shrank out to the size in its header with zeroes (a hole), like GNU tar does.
+	if available < header.Size {
+		if err := tarfile.Truncate(body_offset + header.Size); err != nil {
+			return errorDuringOp{Path: tarfile.Name(), Op: "ftruncate()", Err: err}
 		}
-		pad512(archive, newpos)
 	}
 	return nil
 }
 
-func copyrange_into_archive(srcfile *os.File, tarfile *os.File, header *tar.Header) error {
+func ficlone_into_archive(srcfile *os.File, src_offset int64, archive *os.File, header *tar.Header, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (was_cloned bool, abort_err error) {
+	// Clones the body into the archive. If it can't be cloned, nothing is written, so that the caller can copy it instead.
+	pos := tell(archive)
+	available, src_size, abort_err := available_body(srcfile, src_offset, header)
+	if abort_err != nil {
+		return
+	}
+	// Exactly the body is cloned, even if the file has grown since its header was made.
+	clone_length, page_spill := available, int64(0)
+	if src_offset+available != src_size {
+		// Not cloning up to the end of the source file (as it's another archive, or a file that grew); only whole blocks
+		// can be cloned then, the remainder is copied.
+		page_spill = available % layout.block_size
+		clone_length = available - page_spill
+	}
+	clone := func() (bool, error) {
+		if clone_length == 0 {
+			return false, nil // which FICLONERANGE would take as "up to the end of the source file"
+		}
+		return clone_range(int(srcfile.Fd()), src_offset, clone_length, int(archive.Fd()), pos, srcfile.Name(), archive_progress)
+	}
+	was_cloned, abort_err = clone()
+	if abort_err == nil && !was_cloned && page_spill == 0 && clone_length%layout.block_size != 0 {
+		// The file may have grown just now, so that its last block isn't up to the end of the file anymore
+		page_spill = clone_length % layout.block_size
+		clone_length -= page_spill
+		was_cloned, abort_err = clone()
+	}
+	if abort_err != nil || !was_cloned {
+		return false, abort_err
+	}
+	layout.cloned_bytes += clone_length
+	if page_spill > 0 {
+		if abort_err = copy_range(int(srcfile.Fd()), src_offset+clone_length, page_spill, int(archive.Fd()), pos+clone_length, srcfile.Name(), archive_progress); abort_err != nil {
+			return
+		}
+	}
+	if abort_err = zerofill_body(archive, pos, available, header); abort_err != nil {
+		return
+	}
+	newpos, _ := archive.Seek(0, io.SeekEnd)
+	if written := newpos - pos; written != header.Size {
+		return was_cloned, fmt.Errorf(error_writesize, "reading", header.Name, written, header.Size)
+	}
+	return was_cloned, pad512(archive, newpos)
+}
+
+func copyrange_into_archive(srcfile *os.File, src_offset int64, tarfile *os.File, header *tar.Header, archive_progress *(chan ProgressMessage)) error {
 	pos := tell(tarfile)
-	var infile_offset int64 = 0
-	written, copy_err := unix.CopyFileRange(int(srcfile.Fd()), &infile_offset, int(tarfile.Fd()), &pos, int(header.Size), 0)
-	if copy_err != nil {
-		return errorDuringOp{Path: srcfile.Name(), Op: "copy_file_range()", Err: copy_err}
+	available, _, abort_err := available_body(srcfile, src_offset, header)
+	if abort_err != nil {
+		return abort_err
+	}
+	if abort_err = copy_range(int(srcfile.Fd()), src_offset, available, int(tarfile.Fd()), pos, srcfile.Name(), archive_progress); abort_err != nil {
+		return abort_err
+	}
+	if abort_err = zerofill_body(tarfile, pos, available, header); abort_err != nil {
+		return abort_err
+	}
+	return pad512(tarfile, pos+header.Size)
+}
+
+func tarwrite(tarfile *os.File, header *tar.Header, source_path string, layout *archiveLayout, sparse bool, archive_progress *(chan ProgressMessage)) (was_cloned bool, abort_err error) {
+	if header.Typeflag != tar.TypeReg || header.Size == 0 {
+		return tarwrite_from(tarfile, header, nil, 0, layout, archive_progress)
+	}
+	infile, abort_err := os.OpenFile(source_path, os.O_RDONLY|unix.O_NOATIME, 0)
+	if errors.Is(abort_err, unix.EPERM) {
+		// unprivileged users can only request O_NOATIME for their own files
+		infile, abort_err = os.OpenFile(source_path, os.O_RDONLY, 0)
+	}
+	if abort_err != nil {
+		return was_cloned, sourceError{abort_err}
+	}
+	defer infile.Close()
+	var before unix.Stat_t
+	if abort_err = unix.Fstat(int(infile.Fd()), &before); abort_err != nil {
+		return was_cloned, sourceError{errorDuringOp{Path: source_path, Op: "fstat()", Err: abort_err}}
+	}
+	if sparse {
+		extents, has_holes, extents_err := data_extents(infile, header.Size)
+		if extents_err != nil {
+			return was_cloned, sourceError{extents_err}
+		}
+		if has_holes {
+			was_cloned, abort_err = tarwrite_sparse(tarfile, header, infile, extents, layout, archive_progress)
+		} else {
+			was_cloned, abort_err = tarwrite_from(tarfile, header, infile, 0, layout, archive_progress)
+		}
+	} else {
+		was_cloned, abort_err = tarwrite_from(tarfile, header, infile, 0, layout, archive_progress)
 	}
-	if int64(written) != header.Size {
-		return fmt.Errorf(error_writesize, "writing", srcfile.Name(), written, header.Size)
+	if abort_err == nil {
+		warn_if_changed(infile, header, &before, archive_progress)
 	}
-	return pad512(tarfile, pos)
+	return
 }
 
-func tarwrite(tarfile *os.File, header *tar.Header) (was_cloned bool, abort_err error) {
+func warn_if_changed(infile *os.File, header *tar.Header, before *unix.Stat_t, archive_progress *(chan ProgressMessage)) {
+	// Like GNU tar, carry on when a file changes while it's being archived, but do say so. What's in the archive is
+	// header.Size bytes of it, padded with zeroes if it shrank.
+	var after unix.Stat_t
+	if unix.Fstat(int(infile.Fd()), &after) != nil {
+		return
+	}
+	if shrunk_by := header.Size - min(before.Size, after.Size); shrunk_by > 0 {
+		warning_message(archive_progress, fmt.Sprintf("%s: File shrank by %d bytes; padding with zeros", infile.Name(), shrunk_by))
+	} else if before.Size != header.Size || after.Size != before.Size || after.Mtim != before.Mtim || after.Ctim != before.Ctim {
+		warning_message(archive_progress, fmt.Sprintf("%s: file changed as we read it", infile.Name()))
+	}
+}
+
+func tarwrite_from(tarfile *os.File, header *tar.Header, infile *os.File, src_offset int64, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (was_cloned bool, abort_err error) {
+	// Writes a member with its body taken from infile, starting at src_offset. That's 0 for files being archived,
+	// and the body offset for members taken from other archives.
 	was_cloned = false
 	pos_header := tell(tarfile)
 	var pristine_header_buf bytes.Buffer
 	pristine_tarbuf := tar.NewWriter(&pristine_header_buf)
-	pristine_tarbuf.WriteHeader(header)
+	if abort_err = pristine_tarbuf.WriteHeader(header); abort_err != nil {
+		// Something about the file that tar can't record
+		return was_cloned, sourceError{errorDuringOp{Path: header.Name, Op: "WriteHeader", Err: abort_err}}
+	}
 	if header.Typeflag != tar.TypeReg || header.Size == 0 {
 		// Just write the normal header, and no body. No tricks required.
-		_, abort_err = pristine_header_buf.WriteTo(tarfile)
-		return
-	}
-	infile, abort_err := os.OpenFile(header.Name, os.O_RDONLY|unix.O_NOATIME, 0)
-	if abort_err != nil {
-		if !errors.Is(abort_err, unix.EPERM) {
+		if _, abort_err = pristine_header_buf.WriteTo(tarfile); abort_err != nil || infile == nil || !has_body(header) || header.Size == 0 {
 			return
-		} else {
-			// unprivileged users can only request O_NOATIME for their own files
-			infile, abort_err = os.OpenFile(header.Name, os.O_RDONLY, 0)
-			if abort_err != nil {
-				return
-			}
-			defer infile.Close()
 		}
+		// Some exotic record type that does have a body, such as a GNU dumpdir; carry it over verbatim.
+		abort_err = copyrange_into_archive(infile, src_offset, tarfile, header, archive_progress)
+		return
 	}
-	header_growth, padded_header_buf := pad_tarheader(header, pos_header)
-	if int64(header_growth) > header.Size {
+	header_growth, padded_header_buf := pad_tarheader(header, pos_header, layout.alignment)
+	if !worth_aligning(layout, header_growth, header.Size) || clone_ruled_out(int(infile.Fd()), int(tarfile.Fd())) {
 		// Copying rather than cloning as the file's size is smaller than its clone-required header alignment padding would be
+		// (or than the minimum clone size), or as the filesystems turned out not to clone between them before.
 		if _, abort_err = pristine_header_buf.WriteTo(tarfile); abort_err != nil {
 			return
 		}
-		abort_err = copyrange_into_archive(infile, tarfile, header)
+		abort_err = copyrange_into_archive(infile, src_offset, tarfile, header, archive_progress)
+	} else if src_offset%layout.block_size != 0 || layout.alignment%layout.block_size != 0 {
+		// The source isn't block-aligned (it's a member of an archive not made by deduptar), or this archive isn't laid
+		// out in whole blocks, so there's nothing to clone. Still pad the header, so that the body ends up aligned in
+		// this archive, where it can be cloned out later.
+		if _, abort_err = padded_header_buf.WriteTo(tarfile); abort_err != nil {
+			return
+		}
+		layout.padding_bytes += int64(header_growth)
+		abort_err = copyrange_into_archive(infile, src_offset, tarfile, header, archive_progress)
 	} else {
 		// Clone time
 		if _, abort_err = padded_header_buf.WriteTo(tarfile); abort_err != nil {
 			return
 		}
-		ficlone_err := ficlone_into_archive(infile, tarfile, header)
-		if ficlone_err != nil {
-			log.Fatalln(ficlone_err)
-			if errors.Is(ficlone_err, syscall.EXDEV) {
-				// Uncloneable; cross-filesystem. Not fatal!
-				if header_growth > 0 {
-					// We used header padding so that we could clone, but it didn't work out. Be tidy and use the unpadded header then.
-					// Roll back & re-apply.
-					tarfile.Seek(pos_header, io.SeekStart)
-					tarfile.Truncate(pos_header)
-					if _, abort_err = pristine_header_buf.WriteTo(tarfile); abort_err != nil {
-						return
-					}
-				}
-				abort_err = copyrange_into_archive(infile, tarfile, header)
+		if was_cloned, abort_err = ficlone_into_archive(infile, src_offset, tarfile, header, layout, archive_progress); abort_err != nil || was_cloned {
+			if was_cloned {
+				layout.padding_bytes += int64(header_growth)
+			}
+			return
+		}
+		// Uncloneable; across filesystems, or the filesystem doesn't do it, or the source is NOCOW. Not fatal!
+		if header_growth > 0 {
+			// We used header padding so that we could clone, but it didn't work out. Be tidy and use the unpadded header then.
+			// Roll back & re-apply.
+			if _, abort_err = tarfile.Seek(pos_header, io.SeekStart); abort_err != nil {
+				return was_cloned, errorDuringOp{Path: tarfile.Name(), Op: "seek()", Err: abort_err}
+			}
+			if abort_err = tarfile.Truncate(pos_header); abort_err != nil {
+				return was_cloned, errorDuringOp{Path: tarfile.Name(), Op: "ftruncate()", Err: abort_err}
+			}
+			if _, abort_err = pristine_header_buf.WriteTo(tarfile); abort_err != nil {
+				return
 			}
-		} else {
-			was_cloned = true
 		}
+		abort_err = copyrange_into_archive(infile, src_offset, tarfile, header, archive_progress)
 	}
 	return
 }
 
-func pad_tarheader(header *tar.Header, header_offset int64) (header_growth int, header_buffer *bytes.Buffer) {
+func tarwrite_stream(tarfile *os.File, header *tar.Header, body io.Reader, layout *archiveLayout) (abort_err error) {
+	// Writes a member with its body read from a stream, which can't be cloned from. The header is padded
+	// all the same, so that the body can be cloned out of this archive later on.
+	pos_header := tell(tarfile)
+	var pristine_header_buf bytes.Buffer
+	pristine_tarbuf := tar.NewWriter(&pristine_header_buf)
+	if abort_err = pristine_tarbuf.WriteHeader(header); abort_err != nil {
+		return errorDuringOp{Path: header.Name, Op: "WriteHeader", Err: abort_err}
+	}
+	header_buf := &pristine_header_buf
+	if header.Typeflag == tar.TypeReg && header.Size > 0 {
+		if header_growth, padded_header_buf := pad_tarheader(header, pos_header, layout.alignment); worth_aligning(layout, header_growth, header.Size) {
+			header_buf = padded_header_buf
+			layout.padding_bytes += int64(header_growth)
+		}
+	}
+	if _, abort_err = header_buf.WriteTo(tarfile); abort_err != nil || !has_body(header) || header.Size == 0 {
+		return
+	}
+	if written, copy_err := io.CopyN(tarfile, body, header.Size); copy_err != nil {
+		if copy_err == io.EOF {
+			return fmt.Errorf(error_writesize, "writing", header.Name, written, header.Size)
+		}
+		return errorDuringOp{Path: header.Name, Op: "copying", Err: copy_err}
+	}
+	return pad512(tarfile, 0)
+}
+
+func strip_padding(header *tar.Header) {
+	// Removes the PAX comment record that deduptar uses for padding, so that the header can be padded anew.
+	if padding, has_padding := header.PAXRecords[pax_padding_headerkey]; has_padding && len(strings.Trim(padding, pax_filler_char)) == 0 {
+		delete(header.PAXRecords, pax_padding_headerkey)
+	}
+}
+
+func copy_member(tarfile *os.File, srcfile *os.File, member *archiveMember, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (was_cloned bool, abort_err error) {
+	// Transplants a member of another archive into this one, cloning its body where possible.
+	header := detach_header(member.header)
+	if is_sparse(header) && is_pax1_sparse(header) {
+		// The body is a sparse map followed by the data fragments, which is carried over as it is.
+		unsparsify_header(header)
+		return copy_sparse_member(tarfile, srcfile, member, header, layout, archive_progress)
+	} else if is_sparse(header) {
+		// One of GNU tar's older sparse formats; expand it into a regular member.
+		unsparsify_header(header)
+		body, open_err := open_member_body(srcfile, member)
+		if open_err != nil {
+			return was_cloned, open_err
+		}
+		return was_cloned, tarwrite_stream(tarfile, header, body, layout)
+	}
+	return tarwrite_from(tarfile, header, srcfile, member.body_offset, layout, archive_progress)
+}
+
+func detach_header(original *tar.Header) *tar.Header {
+	// Copies a header read from an archive, so that it can be modified and written anew without its old padding.
+	header := *original
+	header.PAXRecords = make(map[string]string, len(original.PAXRecords))
+	for key, value := range original.PAXRecords {
+		header.PAXRecords[key] = value
+	}
+	strip_padding(&header)
+	header.Format = tar.FormatPAX
+	return &header
+}
+
+func unsparsify_header(header *tar.Header) {
+	// Turns the header of a sparse member into that of a regular member holding the expanded data.
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			delete(header.PAXRecords, key)
+		}
+	}
+	header.Typeflag = tar.TypeReg
+}
+
+func pad_tarheader(header *tar.Header, header_offset int64, alignment int64) (header_growth int, header_buffer *bytes.Buffer) {
 	// Measure the size of a pristine header block
 	var pristine_header_buf bytes.Buffer
 	pristine_tarbuf := tar.NewWriter(&pristine_header_buf)
 	if ouch := pristine_tarbuf.WriteHeader(header); ouch != nil {
 		log.Fatalf("error writing header: %s", ouch)
 	}
-	padout_size := int(FS_PAGESIZE - ((header_offset + int64(pristine_header_buf.Len())) % FS_PAGESIZE))
+	padout_size := int((alignment - ((header_offset + int64(pristine_header_buf.Len())) % alignment)) % alignment)
 	if padout_size == 0 {
 		// No padding tricks required
 		return 0, &pristine_header_buf
 	}
-	// Pad the tar header out for page-alignment of the file body.
+	// Pad the tar header out for alignment of the file body.
 	// First measure the size of the header with PAX header overhead.
-	header.PAXRecords = make(map[string]string)
+	padded_records := make(map[string]string, len(header.PAXRecords)+1)
+	for key, value := range header.PAXRecords {
+		padded_records[key] = value
+	}
+	header.PAXRecords = padded_records
 	header.PAXRecords[pax_padding_headerkey] = pax_filler_char // need to have something here, as special "delete previous pax header" semantics apply to a zero-length value
 	var padded_header_buffer bytes.Buffer
 	padded_tarbuf := tar.NewWriter(&padded_header_buffer)
@@ -138,7 +326,7 @@ func pad_tarheader(header *tar.Header, header_offset int64) (header_growth int,
 	// A complicating factor is that the size of the record is dependent
 	// on... its own size, as its own size is encoded string-decimally in a variable-length field in the record itself!
 	// See https://web.archive.org/web/20230706143859/https://www.ibm.com/docs/en/zos/2.3.0?topic=SSLTBW_2.3.0/com.ibm.zos.v2r3.bpxa500/paxex.html
-	left_to_pad := FS_PAGESIZE - ((header_offset + int64(paxed_size)) % FS_PAGESIZE)
+	left_to_pad := (alignment - ((header_offset + int64(paxed_size)) % alignment)) % alignment
 	if left_to_pad == 0 {
 		// Coincidentally spot on with a PAX value of length 1
 		return padded_header_buffer.Len() - pristine_header_buf.Len(), &padded_header_buffer
@@ -178,32 +366,248 @@ func pad_tarheader(header *tar.Header, header_offset int64) (header_growth int,
 		log.Fatalf("error writing header: %s", ouch)
 	}
 
-	if targeted_headersize, created_headersize := padout_size+pristine_header_buf.Len(), padded_header_buffer.Len(); targeted_headersize != created_headersize {
+	// Mind that the padded header doesn't necessarily end on the page boundary closest to the pristine header; if the pristine header had
+	// no PAX records yet, adding them may well push it across that boundary.
+	if targeted_headersize, created_headersize := int(paxed_size)+int(left_to_pad), padded_header_buffer.Len(); targeted_headersize != created_headersize {
 		log.Fatalf("header padding miscalculation: wanted %d, got %d", targeted_headersize, created_headersize)
 	}
 
 	return padded_header_buffer.Len() - pristine_header_buf.Len(), &padded_header_buffer
 }
 
-func Archive(dst_archive *string, inpaths []string, follow_symlinks *bool, no_recurse *bool, archive_progress *(chan ProgressMessage)) (abort_err error) {
-	visited_registry := make(map[nodeID]struct{})
-	hardlink_registry := make(map[nodeID]string)
-	outfile, abort_err := os.Create(*dst_archive)
+type ArchiveOptions struct {
+	FollowSymlinks bool
+	NoRecursion    bool
+	Excludes       []string    // GNU tar style glob patterns of member names to leave out
+	Anchored       bool        // whether Excludes must match from the start of the member name, rather than after any '/'
+	Newer          *time.Time  // if set, only archive non-directories whose data or status changed after this time
+	NewerMtime     *time.Time  // if set, only archive non-directories whose data changed after this time
+	OneFileSystem  bool        // don't descend into directories on other filesystems than the argument they were found under
+	ExcludeCaches  bool        // leave out the contents of directories tagged as caches, except for the tag itself
+	HonorNodump    bool        // leave out files with the nodump attribute (chattr +d)
+	Directory      string      // if set, relative FILES are taken relative to this directory, like with GNU tar's -C
+	Transforms     []string    // GNU tar style sed expressions to rewrite member names with
+	AbsoluteNames  bool        // keep leading '/' and '..' components in member names
+	Overrides      *MemberEdit // if set, metadata to record for all files instead of their own (except for the name)
+	ClampMtime     bool        // only override the modification time of files modified later than that
+	NumericOwner   bool        // leave out user and group names
+	DirectoryOrder bool        // archive directory entries in the order the filesystem lists them, rather than sorted by name
+	NoAtimeCtime   bool        // leave out access and status change times
+	Fflags         bool        // record file flags (chattr attributes)
+	Sparse         bool        // store files with holes as PAX 1.0 sparse members
+	Freakout       bool        // abort upon the first file that can't be archived, rather than skipping it with a warning
+	Packed         bool        // hold back files too small to clone, to fill the gaps in front of aligned members with
+	LayoutOptions
+	XattrOptions
+}
+
+type archiveSession struct {
+	// The state of archiving a set of files into one archive
+	tarfile           *os.File
+	layout            *archiveLayout
+	archive_nodes     map[nodeID]struct{} // the archive itself, which may well be among the files being archived
+	options           *ArchiveOptions
+	excludes          []*regexp.Regexp
+	transforms        []nameTransform
+	stripped_prefixes map[string]bool // unsafe member name prefixes that have been warned about
+	visited_registry  map[nodeID]struct{}
+	hardlink_registry map[nodeID]string
+	archived_versions map[string]*tar.Header // if not nil, files that are in here unchanged are not archived again
+	archive_progress  *(chan ProgressMessage)
+	allgood           bool           // false once a file has been skipped
+	held_back         []heldBackFile // with the packed layout, small files that are yet to be written
+	held_back_size    int64
+}
+
+type heldBackFile struct {
+	header      *tar.Header
+	source_path string
+	member_size int64 // header and body, as it takes up room in the archive
+}
+
+func new_archive_session(tarfile *os.File, options *ArchiveOptions, archive_progress *(chan ProgressMessage)) (session *archiveSession, abort_err error) {
+	session = &archiveSession{
+		tarfile:           tarfile,
+		options:           options,
+		visited_registry:  make(map[nodeID]struct{}),
+		hardlink_registry: make(map[nodeID]string),
+		stripped_prefixes: make(map[string]bool),
+		archive_progress:  archive_progress,
+		allgood:           true,
+	}
+	var tarfile_stat unix.Stat_t
+	if abort_err = unix.Fstat(int(tarfile.Fd()), &tarfile_stat); abort_err != nil {
+		return nil, errorDuringOp{Path: tarfile.Name(), Op: "fstat()", Err: abort_err}
+	}
+	session.archive_nodes = map[nodeID]struct{}{{tarfile_stat.Dev, tarfile_stat.Ino}: {}}
+	if session.layout, abort_err = archive_layout(tarfile, &options.LayoutOptions); abort_err != nil {
+		return
+	}
+	if options.Packed && options.MinCloneSize == 0 {
+		session.layout.min_clone_size = packed_min_clone_size
+	}
+	if session.excludes, abort_err = compile_excludes(options.Excludes, options.Anchored); abort_err != nil {
+		return
+	}
+	if session.transforms, abort_err = parse_transforms(options.Transforms); abort_err != nil {
+		return
+	}
+	abort_err = validate_xattr_patterns(&options.XattrOptions)
+	return
+}
+
+func source_path_of(inpath string, options *ArchiveOptions) string {
+	// Where to find the file named as inpath on the command line
+	if filepath.IsAbs(inpath) || len(options.Directory) == 0 {
+		return inpath
+	}
+	return filepath.Join(options.Directory, inpath)
+}
+
+func Archive(dst_archive *string, inpaths []string, options *ArchiveOptions, archive_progress *(chan ProgressMessage)) (allgood bool, abort_err error) {
+	// The archive replaces whatever was at dst_archive only once it's complete.
+	output, abort_err := create_archive(*dst_archive)
+	if abort_err != nil {
+		return
+	}
+	defer discard_archive(output)
+	session, abort_err := new_archive_session(output.file, options, archive_progress)
+	if abort_err != nil {
+		return
+	}
+	if replaced_stat, stat_err := os.Stat(*dst_archive); stat_err == nil {
+		// The archive we're replacing is as much "the archive" as far as the user is concerned
+		unixstat, _ := replaced_stat.Sys().(*syscall.Stat_t)
+		session.archive_nodes[nodeID{unixstat.Dev, unixstat.Ino}] = struct{}{}
+	}
+	if abort_err = write_layout_header(output.file, session.layout); abort_err != nil {
+		return
+	}
+	for _, inpath := range inpaths {
+		if abort_err = archive_one_recursively(session, source_path_of(inpath, options), filepath.Clean(inpath), nil); abort_err != nil {
+			return
+		}
+	}
+	if abort_err = write_held_back(session); abort_err != nil {
+		return
+	}
+	if abort_err = finalize_tar(output.file); abort_err != nil {
+		return
+	}
+	report_layout(session.layout, archive_progress)
+	return session.allgood, commit_archive(output)
+}
+
+func Append(dst_archive *string, inpaths []string, options *ArchiveOptions, archive_progress *(chan ProgressMessage)) (allgood bool, abort_err error) {
+	return append_to_archive(dst_archive, inpaths, options, false, archive_progress)
+}
+
+func Update(dst_archive *string, inpaths []string, options *ArchiveOptions, archive_progress *(chan ProgressMessage)) (allgood bool, abort_err error) {
+	return append_to_archive(dst_archive, inpaths, options, true, archive_progress)
+}
+
+func append_to_archive(dst_archive *string, inpaths []string, options *ArchiveOptions, only_changed bool, archive_progress *(chan ProgressMessage)) (allgood bool, abort_err error) {
+	outfile, abort_err := os.OpenFile(*dst_archive, os.O_RDWR, 0)
 	if abort_err != nil {
 		return
 	}
 	defer outfile.Close()
+	session, abort_err := new_archive_session(outfile, options, archive_progress)
+	if abort_err != nil {
+		return
+	}
+	finfo, abort_err := outfile.Stat()
+	if abort_err != nil {
+		return
+	}
+	original_size := finfo.Size()
+	var record_version func(member *archiveMember) error
+	if only_changed {
+		// Later members override earlier ones upon extraction, so it's the last occurrence of a path that counts.
+		session.archived_versions = make(map[string]*tar.Header)
+		record_version = func(member *archiveMember) error {
+			session.archived_versions[member.header.Name] = member.header
+			return nil
+		}
+	}
+	if abort_err = reopen_tar(outfile, &session.hardlink_registry, record_version, options); abort_err != nil {
+		return
+	}
+	// Should appending fail, the archive is restored to what it was: reopen_tar only cut off the end-of-archive
+	// marker, which consists of zeroes.
+	archive_end := tell(outfile)
+	restore := func() {
+		outfile.Truncate(archive_end)
+		outfile.Truncate(original_size)
+	}
+	undo_on_interrupt(outfile, restore)
+	defer func() {
+		forget_undo(outfile)
+		if abort_err != nil {
+			restore()
+		}
+	}()
+	if archive_end == 0 {
+		// Appending to an empty file makes a new archive
+		if abort_err = write_layout_header(outfile, session.layout); abort_err != nil {
+			return
+		}
+	}
 	for _, inpath := range inpaths {
-		if abort_err = archive_one_recursively(outfile, inpath, &visited_registry, &hardlink_registry, follow_symlinks, no_recurse, archive_progress); abort_err != nil {
+		if abort_err = archive_one_recursively(session, source_path_of(inpath, options), filepath.Clean(inpath), nil); abort_err != nil {
 			return
 		}
 	}
-	abort_err = finalize_tar(outfile)
+	if abort_err = write_held_back(session); abort_err != nil {
+		return
+	}
+	if abort_err = finalize_tar(outfile); abort_err != nil {
+		return
+	}
+	report_layout(session.layout, archive_progress)
+	return session.allgood, nil
+}
+
+func reopen_tar(tarfile *os.File, hardlink_registry *map[nodeID]string, visit func(member *archiveMember) error, options *ArchiveOptions) (abort_err error) {
+	// Positions the archive for appending: the end-of-archive marker is chopped off, and the hardlink registry is
+	// rebuilt from the members already present, so that new links to inodes archived earlier become hardlink records.
+	// That only works for members whose name still leads to the file, so not for those that were transformed.
+	archive_end, abort_err := index_archive(tarfile, 0, func(member *archiveMember) error {
+		if hardlink_registry != nil && member.header.Typeflag == tar.TypeReg {
+			var finfo os.FileInfo
+			var stat_err error
+			if source_path := source_path_of(member.header.Name, options); options.FollowSymlinks {
+				finfo, stat_err = os.Stat(source_path)
+			} else {
+				finfo, stat_err = os.Lstat(source_path)
+			}
+			if stat_err == nil {
+				if unixstat, _ := finfo.Sys().(*syscall.Stat_t); unixstat.Nlink > 1 {
+					thisnode := nodeID{unixstat.Dev, unixstat.Ino}
+					if _, already_encountered := (*hardlink_registry)[thisnode]; !already_encountered {
+						(*hardlink_registry)[thisnode] = member.header.Name
+					}
+				}
+			}
+		}
+		if visit != nil {
+			return visit(member)
+		}
+		return nil
+	})
+	if abort_err != nil {
+		return
+	}
+	if abort_err = tarfile.Truncate(archive_end); abort_err != nil {
+		return errorDuringOp{Path: tarfile.Name(), Op: "ftruncate()", Err: abort_err}
+	}
+	if _, abort_err = tarfile.Seek(archive_end, io.SeekStart); abort_err != nil {
+		return errorDuringOp{Path: tarfile.Name(), Op: "seek()", Err: abort_err}
+	}
 	return
 }
 
-func archive_one_recursively(tarfile *os.File, inpath string, visited_registry *map[nodeID]struct{}, hardlink_registry *map[nodeID]string, follow_symlinks *bool, no_recurse *bool, archive_progress *(chan ProgressMessage)) (abort_err error) {
-	var finfo os.FileInfo
+func make_header(inpath string, name string, follow_symlinks *bool) (header *tar.Header, finfo os.FileInfo, abort_err error) {
 	var linktarget string
 
 	if *follow_symlinks {
@@ -212,71 +616,358 @@ func archive_one_recursively(tarfile *os.File, inpath string, visited_registry *
 		finfo, abort_err = os.Lstat(inpath)
 	}
 	if abort_err != nil {
-		return errorDuringOp{Path: inpath, Op: "stat()", Err: abort_err}
+		return nil, nil, errorDuringOp{Path: inpath, Op: "stat()", Err: abort_err}
 	}
-	// the golang FileInfo structure doesn't have enough info (device & inode), we need to get the stat_t from under it
-	unixstat, _ := finfo.Sys().(*syscall.Stat_t)
-	thisnode := nodeID{unixstat.Dev, unixstat.Ino}
 	if finfo.Mode().Type() == fs.ModeSymlink {
 		// to store a symlink, we need to know its target too
 		var readlink_err error
 		linktarget, readlink_err = os.Readlink(inpath)
 		if readlink_err != nil {
-			return errorDuringOp{Path: inpath, Op: "readlink()", Err: readlink_err}
+			return nil, nil, errorDuringOp{Path: inpath, Op: "readlink()", Err: readlink_err}
 		}
 	}
 	header, headerify_err := tar.FileInfoHeader(finfo, linktarget)
-	header.Format = tar.FormatPAX // for subsecond precision in timestamps
 	if headerify_err != nil {
-		return errorDuringOp{Path: inpath, Op: "FileInfoHeader", Err: headerify_err}
+		// Such as for sockets
+		return nil, finfo, errorDuringOp{Path: inpath, Op: "FileInfoHeader", Err: headerify_err}
 	}
-	header.Name = path.Join(filepath.Dir(filepath.Clean(inpath)), finfo.Name())
+	header.Format = tar.FormatPAX // for subsecond precision in timestamps
+	header.Name = name
 	if finfo.Mode().IsDir() {
 		header.Name += "/"
 	}
+	return
+}
+
+func archive_one_recursively(session *archiveSession, inpath string, name string, root_dev *uint64) (abort_err error) {
+	// The file at inpath is archived as name, or rather, what the transforms make of it. Excludes apply to the untransformed name.
+	// root_dev is the device of the command line argument that this file was found under, or nil for the argument itself.
+	if is_excluded(name, session.excludes) {
+		return
+	}
+	member_name := apply_transforms(name, transform_names, session.transforms)
+	if !session.options.AbsoluteNames {
+		member_name = strip_unsafe_prefix(member_name, session.stripped_prefixes, session.archive_progress)
+	}
+	header, finfo, abort_err := make_header(inpath, member_name, &session.options.FollowSymlinks)
+	if abort_err != nil {
+		// Such as a file that was removed in the meantime, or a socket; there's no such thing as a socket in an
+		// archive, and it would be gone after a reboot anyway. Either way, it's a file that isn't in the archive.
+		return keep_going(session, abort_err, "Skipping")
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		header.Linkname = apply_transforms(header.Linkname, transform_symlinks, session.transforms)
+	}
+	// the golang FileInfo structure doesn't have enough info (device & inode), we need to get the stat_t from under it
+	unixstat, _ := finfo.Sys().(*syscall.Stat_t)
+	thisnode := nodeID{unixstat.Dev, unixstat.Ino}
+	if _, is_archive := session.archive_nodes[thisnode]; is_archive {
+		// Not only pointless; it would be cloned into itself, as far as it's been written yet
+		warning_message(session.archive_progress, fmt.Sprintf("%s: file is the archive; not dumped", inpath))
+		return
+	}
+	if !finfo.IsDir() && !is_newer(unixstat, session.options) {
+		verbose_message(session.archive_progress, fmt.Sprintf("%-14s\t%s", "not newer", header.Name))
+		return
+	}
+	if session.options.HonorNodump && (finfo.Mode().IsRegular() || finfo.IsDir()) && has_nodump_flag(inpath) {
+		return
+	}
+	if root_dev == nil {
+		root_dev = &thisnode.dev
+	}
+	registered_hardlink := false
+	other_path, already_encountered := "", false
 	if unixstat.Nlink > 1 {
 		// this potentially shares an inode with something we have encountered already, or may encounter later
-		other_path, already_encountered := (*hardlink_registry)[thisnode]
-		if already_encountered {
+		other_path, already_encountered = session.hardlink_registry[thisnode]
+		if already_encountered && other_path != header.Name {
 			header.Typeflag = tar.TypeLink
 			header.Linkname = other_path
 		} else {
-			(*hardlink_registry)[thisnode] = header.Name
+			// Also when the file is in the archive under this very name already, as with -r and -u: a link to
+			// itself wouldn't store the data, so it's archived anew, and later links go to this copy.
+			session.hardlink_registry[thisnode] = header.Name
+			registered_hardlink = true
 		}
 	}
-	was_cloned, abort_err := tarwrite(tarfile, header)
-	if abort_err != nil {
-		return
+	if session.options.Fflags && (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeDir) {
+		record_fflags(header, inpath)
 	}
-	var recordtype string
-	if was_cloned {
-		recordtype = "file (cloned)"
+	if session.options.Xattrs && header.Typeflag != tar.TypeLink {
+		if xattrs_err := record_xattrs(header, inpath, session.options.FollowSymlinks, &session.options.XattrOptions); xattrs_err != nil {
+			if abort_err = keep_going(session, xattrs_err, "Not archiving (all) extended attributes"); abort_err != nil {
+				return
+			}
+		}
+	}
+	// With -u, it's the file as it is that's compared with the archived copy, not what --mtime and such make of it
+	unchanged := session.archived_versions != nil && is_unchanged(header, session.archived_versions[header.Name])
+	apply_overrides(header, session.options)
+	if unchanged {
+		verbose_message(session.archive_progress, fmt.Sprintf("%-14s\t%s", "unchanged", header.Name))
+	} else if session.options.Packed && header.Typeflag == tar.TypeReg && header.Size > 0 && header.Size < session.layout.min_clone_size && !registered_hardlink {
+		// Held back to fill a gap with later on. Not so files with more links, as hardlink records would precede them
+		// then, nor empty files, which have no body to fill a gap with. The directory it's in has been written
+		// already, so that's where it still gets extracted to.
+		if abort_err = hold_back(session, header, inpath); abort_err != nil {
+			return
+		}
 	} else {
-		recordtype = humanize_tar_recordtype(header.Typeflag)
+		if session.options.Packed {
+			if abort_err = fill_gap(session, header); abort_err != nil {
+				return
+			}
+		}
+		if write_err, abort_err := write_member(session, header, inpath); write_err != nil || abort_err != nil {
+			if abort_err != nil {
+				return abort_err
+			}
+			if registered_hardlink && already_encountered {
+				session.hardlink_registry[thisnode] = other_path
+			} else if registered_hardlink {
+				delete(session.hardlink_registry, thisnode)
+			}
+			return keep_going(session, write_err, "Skipping")
+		}
 	}
-	verbose_message(archive_progress, fmt.Sprintf("%-14s\t%s", recordtype, header.Name))
-	if finfo.Mode().IsDir() && !*no_recurse {
-		thestat := new(unix.Stat_t)
-		unix.Stat(header.Name, thestat)
-		_, already_visited := (*visited_registry)[thisnode]
+	if finfo.Mode().IsDir() && !session.options.NoRecursion {
+		_, already_visited := session.visited_registry[thisnode]
 		if already_visited {
-			warning_message(archive_progress, fmt.Sprintf("Skipping directory (already visited): %s", inpath))
+			warning_message(session.archive_progress, fmt.Sprintf("Skipping directory (already visited): %s", inpath))
+		} else if session.options.OneFileSystem && thisnode.dev != *root_dev {
+			verbose_message(session.archive_progress, fmt.Sprintf("%-14s\t%s", "other fs", header.Name))
 		} else {
-			(*visited_registry)[thisnode] = struct{}{}
-			files, err := os.ReadDir(header.Name)
+			session.visited_registry[thisnode] = struct{}{}
+			files, err := read_directory(inpath, !session.options.DirectoryOrder)
 			if err != nil {
-				return errorDuringOp{Path: inpath, Op: "readdir()", Err: err}
+				// The directory itself is archived already
+				return keep_going(session, errorDuringOp{Path: inpath, Op: "readdir()", Err: err}, "Skipping contents")
 			}
+			if session.options.ExcludeCaches && is_cachedir(inpath, files) {
+				// Only the tag is kept, so that the directory is still recognizable as a cache when extracted.
+				verbose_message(session.archive_progress, fmt.Sprintf("%-14s\t%s", "cache dir", header.Name))
+				files = []os.DirEntry{}
+				if cachedir_tag, stat_err := os.Lstat(filepath.Join(inpath, cachedir_tagname)); stat_err == nil {
+					files = append(files, fs.FileInfoToDirEntry(cachedir_tag))
+				}
+			}
+			// With the packed layout, gaps in this directory are only filled with its own small files, and those are all
+			// written before the walk leaves it. Files extracted into a directory after a member outside of it would
+			// change its modification time after tars like GNU tar have restored it.
+			outer_held_back, outer_held_back_size := session.held_back, session.held_back_size
+			session.held_back, session.held_back_size = nil, 0
 			for _, file := range files {
-				if abort_err = archive_one_recursively(tarfile, filepath.Join(header.Name, file.Name()), visited_registry, hardlink_registry, follow_symlinks, no_recurse, archive_progress); abort_err != nil {
+				if abort_err = archive_one_recursively(session, filepath.Join(inpath, file.Name()), path.Join(name, file.Name()), root_dev); abort_err != nil {
 					return
 				}
 			}
+			if abort_err = write_held_back(session); abort_err != nil {
+				return
+			}
+			session.held_back, session.held_back_size = outer_held_back, outer_held_back_size
+		}
+	}
+	return
+}
+
+func write_member(session *archiveSession, header *tar.Header, inpath string) (write_err error, abort_err error) {
+	// Trouble with the file itself is a write_err, after which archiving may carry on. Trouble with the archive,
+	// such as running out of space, is an abort_err.
+	// Interrupt() waits for the member to be written (or taken out again), so that what it undoes stays undone.
+	undo_lock.Lock()
+	pos_member := tell(session.tarfile)
+	was_cloned, tarwrite_err := tarwrite(session.tarfile, header, inpath, session.layout, session.options.Sparse, session.archive_progress)
+	if tarwrite_err != nil {
+		// Such as a file we may not read; take out whatever was written of it already.
+		abort_err = truncate_at(session.tarfile, pos_member)
+		var source_err sourceError
+		if !errors.As(tarwrite_err, &source_err) {
+			// Writing the archive failed, which would go for the next file just the same
+			abort_err = tarwrite_err
+		} else if abort_err == nil {
+			write_err = tarwrite_err
 		}
 	}
+	undo_lock.Unlock()
+	if tarwrite_err != nil {
+		return
+	}
+	var recordtype string
+	if was_cloned {
+		recordtype = "file (cloned)"
+	} else {
+		recordtype = humanize_tar_recordtype(header.Typeflag)
+	}
+	verbose_message(session.archive_progress, fmt.Sprintf("%-14s\t%s", recordtype, header.Name))
 	return
 }
 
+func hold_back(session *archiveSession, header *tar.Header, inpath string) error {
+	// Small files are written once they fit in front of an aligned member, where there would be padding otherwise.
+	var header_buf bytes.Buffer
+	if err := tar.NewWriter(&header_buf).WriteHeader(header); err != nil {
+		return keep_going(session, errorDuringOp{Path: header.Name, Op: "WriteHeader", Err: err}, "Skipping")
+	}
+	member_size := int64(header_buf.Len()) + (header.Size+TAR_BLOCKSIZE-1)/TAR_BLOCKSIZE*TAR_BLOCKSIZE
+	session.held_back = append(session.held_back, heldBackFile{header: header, source_path: inpath, member_size: member_size})
+	session.held_back_size += member_size
+	if len(session.held_back) > max_held_back_files || session.held_back_size > max_held_back_size {
+		// Rather than keeping the lot in memory, and looking through all of it for each aligned member
+		return write_held_back(session)
+	}
+	return nil
+}
+
+func write_held_back(session *archiveSession) error {
+	// Writes out the files that are still held back, back to back.
+	held_back := session.held_back
+	session.held_back, session.held_back_size = nil, 0
+	for _, file := range held_back {
+		if write_err, abort_err := write_member(session, file.header, file.source_path); abort_err != nil {
+			return abort_err
+		} else if write_err != nil {
+			if abort_err = keep_going(session, write_err, "Skipping"); abort_err != nil {
+				return abort_err
+			}
+		}
+	}
+	return nil
+}
+
+func fill_gap(session *archiveSession, header *tar.Header) error {
+	// Writes held back files where the header of this member would be padded, as long as its body still starts
+	// at the same offset.
+	if header.Typeflag != tar.TypeReg || header.Size < session.layout.min_clone_size {
+		return nil
+	}
+	// Padding a header adds a record to it, so the padding is worked out on a copy.
+	padded_size := func(pos int64) (int64, int64) {
+		probe := *header
+		header_growth, padded_header_buf := pad_tarheader(&probe, pos, session.layout.alignment)
+		return int64(header_growth), int64(padded_header_buf.Len())
+	}
+	pos := tell(session.tarfile)
+	room, header_size := padded_size(pos)
+	body_offset := pos + header_size
+	for i := 0; i < len(session.held_back) && room > 0; {
+		file := session.held_back[i]
+		if file.member_size > room {
+			i++
+			continue
+		}
+		if _, shifted_header_size := padded_size(pos + file.member_size); pos+file.member_size+shifted_header_size != body_offset {
+			// The padding record takes up room of its own
+			i++
+			continue
+		}
+		session.held_back = append(session.held_back[:i], session.held_back[i+1:]...)
+		session.held_back_size -= file.member_size
+		if write_err, abort_err := write_member(session, file.header, file.source_path); abort_err != nil {
+			return abort_err
+		} else if write_err != nil {
+			if abort_err = keep_going(session, write_err, "Skipping"); abort_err != nil {
+				return abort_err
+			}
+		}
+		// The file may have been written sparse, or not at all
+		pos = tell(session.tarfile)
+		if room, header_size = padded_size(pos); pos+header_size != body_offset {
+			return nil
+		}
+	}
+	return nil
+}
+
+func keep_going(session *archiveSession, trouble error, consequence string) error {
+	// Unless freaking out, trouble with a file is warned about, after which archiving carries on.
+	if session.options.Freakout {
+		return trouble
+	}
+	warning_message(session.archive_progress, fmt.Sprintf("%s: %v", consequence, trouble))
+	session.allgood = false
+	return nil
+}
+
+func apply_overrides(header *tar.Header, options *ArchiveOptions) {
+	if options.Overrides != nil {
+		overrides := *options.Overrides
+		overrides.Name = nil
+		if options.ClampMtime && overrides.ModTime != nil && !header.ModTime.After(*overrides.ModTime) {
+			overrides.ModTime = nil
+		}
+		apply_edit(header, "", &overrides)
+	}
+	if options.NumericOwner {
+		header.Uname, header.Gname = "", ""
+	}
+	if options.NoAtimeCtime {
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	}
+}
+
+func read_directory(dirpath string, sorted bool) (entries []os.DirEntry, abort_err error) {
+	if sorted {
+		return os.ReadDir(dirpath)
+	}
+	dir, abort_err := os.Open(dirpath)
+	if abort_err != nil {
+		return
+	}
+	defer dir.Close()
+	return dir.ReadDir(-1)
+}
+
+func strip_unsafe_prefix(name string, stripped_prefixes map[string]bool, archive_progress *(chan ProgressMessage)) string {
+	// Like GNU tar, strip leading '/'s, and everything up to the last '..' component, so that extracting the
+	// archive can't write outside of the extraction directory. Each distinct prefix stripped is warned about once.
+	prefix_length := 0
+	for pos := 0; pos < len(name); {
+		if strings.HasPrefix(name[pos:], "..") && (pos+2 == len(name) || name[pos+2] == '/') {
+			prefix_length = pos + 2
+		}
+		if next_slash := strings.IndexByte(name[pos:], '/'); next_slash >= 0 {
+			pos += next_slash + 1
+		} else {
+			break
+		}
+	}
+	for prefix_length < len(name) && name[prefix_length] == '/' {
+		prefix_length++
+	}
+	if prefix_length == 0 {
+		return name
+	}
+	if prefix := name[:prefix_length]; !stripped_prefixes[prefix] {
+		stripped_prefixes[prefix] = true
+		warning_message(archive_progress, fmt.Sprintf("Removing leading '%s' from member names", prefix))
+	}
+	if prefix_length == len(name) {
+		return "."
+	}
+	return name[prefix_length:]
+}
+
+func is_unchanged(header *tar.Header, archived *tar.Header) bool {
+	// Whether the archive already holds this version of the file: same modification time, and for regular files, same size.
+	// A hardlink record has no size of its own, so for those only the timestamp is compared.
+	if archived == nil {
+		return false
+	}
+	mtime := header.ModTime
+	if _, has_mtime_record := archived.PAXRecords["mtime"]; !has_mtime_record {
+		// Without a PAX record (such as in GNU tar's own format), only whole seconds are in the archive
+		mtime = mtime.Truncate(time.Second)
+	}
+	if !mtime.Equal(archived.ModTime) {
+		return false
+	}
+	if header.Typeflag == tar.TypeReg && archived.Typeflag == tar.TypeReg {
+		return header.Size == archived.Size
+	}
+	return true
+}
+
 func pad512(thefile *os.File, len int64) error {
 	// Pad out to 512-byte record boundary
 	if len == 0 {
@@ -298,6 +989,17 @@ func pad512(thefile *os.File, len int64) error {
 	return nil
 }
 
+func truncate_at(tarfile *os.File, offset int64) error {
+	// Cuts off the archive at offset, and continues writing there.
+	if err := tarfile.Truncate(offset); err != nil {
+		return errorDuringOp{Path: tarfile.Name(), Op: "ftruncate()", Err: err}
+	}
+	if _, err := tarfile.Seek(offset, io.SeekStart); err != nil {
+		return errorDuringOp{Path: tarfile.Name(), Op: "seek()", Err: err}
+	}
+	return nil
+}
+
 func finalize_tar(outfile *os.File) (abort_err error) {
 	filelen, abort_err := outfile.Seek(0, io.SeekEnd)
 	if abort_err != nil {
@@ -306,6 +1008,5 @@ func finalize_tar(outfile *os.File) (abort_err error) {
 	if abort_err := outfile.Truncate(filelen + 2*TAR_BLOCKSIZE); abort_err != nil {
 		return errorDuringOp{Path: outfile.Name(), Op: "truncate()", Err: abort_err}
 	}
-	outfile.Close()
 	return
 }
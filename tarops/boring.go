@@ -31,6 +31,21 @@ func (e targetAlreadyExists) Error() string {
 	return fmt.Sprintf("Target already exists: '%s'", e.Path)
 }
 
+type unrestoredMetadata struct {
+	// The member was extracted, but (some of) its metadata couldn't be applied
+	Path string
+	What string
+	Err  error
+}
+
+func (e unrestoredMetadata) Error() string {
+	return fmt.Sprintf("Could not restore %s of '%s': %v", e.What, e.Path, e.Err)
+}
+
+func (e unrestoredMetadata) Unwrap() error {
+	return e.Err
+}
+
 type errorDuringOp struct {
 	Path string
 	Op   string
@@ -41,14 +56,32 @@ func (e errorDuringOp) Error() string {
 	return fmt.Sprintf("During %s of '%s': %v", e.Op, e.Path, e.Err.Error())
 }
 
+func (e errorDuringOp) Unwrap() error {
+	return e.Err
+}
+
+type sourceError struct {
+	// Trouble reading the source of the data, such as the file being archived, rather than writing where it goes
+	Err error
+}
+
+func (e sourceError) Error() string {
+	return e.Err.Error()
+}
+
+func (e sourceError) Unwrap() error {
+	return e.Err
+}
+
 const (
 	VerboseMessage = iota
 	WarningMessage
+	SummaryMessage // shown with or without -v
 )
 
 const (
 	TAR_BLOCKSIZE = 512
-	FS_PAGESIZE   = 4096 // OK, send me an angry email then
+	FS_PAGESIZE   = 4096 // the least alignment archives are laid out with, unless asked otherwise; see archive_layout()
 
 	error_writesize = "While %s file '%s': %d bytes, expected: %d\n"
 	pax_filler_char = "X"
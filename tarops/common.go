@@ -42,3 +42,7 @@ func warning_message(messagechan *(chan ProgressMessage), message string) {
 func verbose_message(messagechan *(chan ProgressMessage), message string) {
 	send_message(messagechan, VerboseMessage, message)
 }
+
+func summary_message(messagechan *(chan ProgressMessage), message string) {
+	send_message(messagechan, SummaryMessage, message)
+}
@@ -0,0 +1,117 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+func Concatenate(dst_archive *string, src_archives []string, layout_options *LayoutOptions, archive_progress *(chan ProgressMessage)) (abort_err error) {
+	dst_stat, stat_err := os.Stat(*dst_archive)
+	if errors.Is(stat_err, os.ErrNotExist) {
+		// Concatenating onto nothing makes a new archive, which only appears once it's complete.
+		return concatenate_new(dst_archive, src_archives, layout_options, archive_progress)
+	} else if stat_err != nil {
+		return stat_err
+	}
+	for _, src_archive := range src_archives {
+		if src_stat, stat_err := os.Stat(src_archive); stat_err == nil && os.SameFile(dst_stat, src_stat) {
+			return errorDuringOp{Path: src_archive, Op: "concatenation", Err: fmt.Errorf("can't concatenate an archive onto itself")}
+		}
+	}
+	outfile, abort_err := os.OpenFile(*dst_archive, os.O_RDWR, 0)
+	if abort_err != nil {
+		return
+	}
+	defer outfile.Close()
+	layout, abort_err := archive_layout(outfile, layout_options)
+	if abort_err != nil {
+		return
+	}
+	original_size := dst_stat.Size()
+	if abort_err = reopen_tar(outfile, nil, nil, nil); abort_err != nil {
+		return
+	}
+	// Like when appending, should concatenating fail, the archive is restored to what it was.
+	archive_end := tell(outfile)
+	restore := func() {
+		outfile.Truncate(archive_end)
+		outfile.Truncate(original_size)
+	}
+	undo_on_interrupt(outfile, restore)
+	defer func() {
+		forget_undo(outfile)
+		if abort_err != nil {
+			restore()
+		}
+	}()
+	if archive_end == 0 {
+		// Concatenating onto an empty file makes a new archive
+		if abort_err = write_layout_header(outfile, layout); abort_err != nil {
+			return
+		}
+	}
+	return concatenate_all(outfile, src_archives, layout, archive_progress)
+}
+
+func concatenate_new(dst_archive *string, src_archives []string, layout_options *LayoutOptions, archive_progress *(chan ProgressMessage)) (abort_err error) {
+	output, abort_err := create_archive(*dst_archive)
+	if abort_err != nil {
+		return
+	}
+	defer discard_archive(output)
+	layout, abort_err := archive_layout(output.file, layout_options)
+	if abort_err != nil {
+		return
+	}
+	if abort_err = write_layout_header(output.file, layout); abort_err != nil {
+		return
+	}
+	if abort_err = concatenate_all(output.file, src_archives, layout, archive_progress); abort_err != nil {
+		return
+	}
+	return commit_archive(output)
+}
+
+func concatenate_all(outfile *os.File, src_archives []string, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (abort_err error) {
+	for _, src_archive := range src_archives {
+		if abort_err = concatenate_one(outfile, src_archive, layout, archive_progress); abort_err != nil {
+			return
+		}
+	}
+	if abort_err = finalize_tar(outfile); abort_err != nil {
+		return
+	}
+	report_layout(layout, archive_progress)
+	return
+}
+
+func concatenate_one(tarfile *os.File, src_archive string, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (abort_err error) {
+	srcfile, abort_err := os.Open(src_archive)
+	if abort_err != nil {
+		return
+	}
+	defer srcfile.Close()
+	_, abort_err = index_archive(srcfile, 0, func(member *archiveMember) error {
+		if is_layout_header(member.header) {
+			return nil
+		}
+		// Interrupt() waits for the member to be written, so that what it undoes stays undone.
+		undo_lock.Lock()
+		was_cloned, copy_err := copy_member(tarfile, srcfile, member, layout, archive_progress)
+		undo_lock.Unlock()
+		if copy_err != nil {
+			return copy_err
+		}
+		var recordtype string
+		if was_cloned {
+			recordtype = "file (cloned)"
+		} else {
+			recordtype = humanize_tar_recordtype(member.header.Typeflag)
+		}
+		verbose_message(archive_progress, fmt.Sprintf("%-14s\t%s", recordtype, member.header.Name))
+		return nil
+	})
+	return
+}
@@ -0,0 +1,241 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	errStopIndexing = errors.New("stop indexing")
+	errCannotSplice = errors.New("layout doesn't allow for in-place modification")
+)
+
+const splice_max_moved = 16 * 1024 * 1024 // at most this many bytes of unaligned members are moved around in place
+
+func member_matches(name string, patterns []string) (matched_pattern string, is_match bool) {
+	// A member matches if it's named as such, or if it's inside a directory that is.
+	name = strings.TrimSuffix(name, "/")
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		if name == pattern || strings.HasPrefix(name, pattern+"/") {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func is_anchor(member *archiveMember, layout *archiveLayout) bool {
+	// Whether a member has an aligned body, which must stay aligned if it is to remain clonable.
+	return member.header.Typeflag == tar.TypeReg && member.header.Size > 0 && !is_sparse(member.header) && member.body_offset%layout.alignment == 0
+}
+
+func Delete(archive *string, patterns []string, archive_progress *(chan ProgressMessage)) (allgood bool, abort_err error) {
+	allgood = true
+	tarfile, abort_err := os.OpenFile(*archive, os.O_RDWR, 0)
+	if abort_err != nil {
+		return
+	}
+	defer tarfile.Close()
+	layout, abort_err := archive_layout(tarfile, nil)
+	if abort_err != nil {
+		return
+	}
+
+	var doomed []archiveMember
+	doomed_by_name := make(map[string]archiveMember)
+	found := make(map[string]bool)
+	has_orphaned_links := false
+	if _, abort_err = index_archive(tarfile, 0, func(member *archiveMember) error {
+		if pattern, is_match := member_matches(member.header.Name, patterns); is_match {
+			doomed = append(doomed, *member)
+			doomed_by_name[member.header.Name] = *member
+			found[pattern] = true
+		} else if _, target_is_doomed := doomed_by_name[member.header.Linkname]; member.header.Typeflag == tar.TypeLink && target_is_doomed {
+			has_orphaned_links = true
+		}
+		return nil
+	}); abort_err != nil {
+		return
+	}
+	for _, pattern := range patterns {
+		if !found[strings.TrimSuffix(pattern, "/")] {
+			warning_message(archive_progress, fmt.Sprintf("Not found in archive: %s", pattern))
+			allgood = false
+		}
+	}
+
+	rewrite := func(left_to_delete []archiveMember) error {
+		// Rewrite the archive without all the members that are still left to delete.
+		if abort_err := rewrite_without(tarfile, patterns, doomed_by_name, layout, archive_progress); abort_err != nil {
+			return abort_err
+		}
+		for j := len(left_to_delete) - 1; j >= 0; j-- {
+			verbose_message(archive_progress, fmt.Sprintf("%-14s\t%s", "rewritten", left_to_delete[j].header.Name))
+		}
+		return nil
+	}
+	if has_orphaned_links {
+		// A hardlink to a deleted member gets to hold the data instead, which there's no room for in place.
+		return allgood, rewrite(doomed)
+	}
+	// Deleting a member only affects the layout of what comes after it, so work from the back to the front.
+	for i := len(doomed) - 1; i >= 0; i-- {
+		strategy, delete_err := delete_in_place(tarfile, &doomed[i], layout, archive_progress)
+		if errors.Is(delete_err, errCannotSplice) {
+			return allgood, rewrite(doomed[:i+1])
+		} else if delete_err != nil {
+			return allgood, delete_err
+		}
+		verbose_message(archive_progress, fmt.Sprintf("%-14s\t%s", strategy, doomed[i].header.Name))
+	}
+	return
+}
+
+func rewrite_without(tarfile *os.File, patterns []string, doomed_by_name map[string]archiveMember, layout *archiveLayout, archive_progress *(chan ProgressMessage)) error {
+	promoted_names := make(map[string]string)
+	return rewrite_archive(tarfile, layout, func(newfile *os.File, member *archiveMember) error {
+		if _, is_match := member_matches(member.header.Name, patterns); is_match {
+			return nil
+		}
+		transplantee := *member
+		if target, target_is_doomed := doomed_by_name[member.header.Linkname]; member.header.Typeflag == tar.TypeLink && target_is_doomed {
+			transplantee = promote_hardlink(transplantee, member.header.Name, &target, promoted_names)
+		}
+		_, copy_err := copy_member(newfile, tarfile, &transplantee, layout, archive_progress)
+		return copy_err
+	})
+}
+
+func promote_hardlink(link archiveMember, original_name string, target *archiveMember, promoted_names map[string]string) archiveMember {
+	// For a hardlink (under the name it gets in the new archive) whose target is left out of the new archive. The first
+	// such hardlink takes the target's place, data and all, and later ones link to that one instead.
+	// promoted_names maps the names of left out targets to the names of the hardlinks that took their place.
+	if promoted_name, is_promoted := promoted_names[link.header.Linkname]; is_promoted && promoted_name != link.header.Name {
+		relinked_header := *link.header
+		relinked_header.Linkname = promoted_name
+		link.header = &relinked_header
+		return link
+	}
+	promoted_header := *target.header
+	promoted_header.Name = link.header.Name
+	if link.header.Linkname != original_name {
+		// A later copy of a name that links to an earlier copy only takes the place of itself
+		promoted_names[link.header.Linkname] = link.header.Name
+	}
+	return archiveMember{header: &promoted_header, header_offset: target.header_offset, body_offset: target.body_offset, end_offset: target.end_offset}
+}
+
+func delete_in_place(tarfile *os.File, doomed *archiveMember, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (strategy string, abort_err error) {
+	// Everything after the doomed member needs to move down. Aligned member bodies must stay aligned, so we can only
+	// move those by multiples of the alignment — which FALLOC_FL_COLLAPSE_RANGE does without rewriting anything.
+	// The first such body after the doomed member is the anchor; between the doomed member and the anchor's body sits the
+	// header of the anchor and possibly some unaligned members, which are rewritten so that they end right on an alignment boundary.
+	// Like with --replace, that region is composed in a scratch file first, and then spliced into place.
+	anchor, moved_bytes, _, abort_err := find_anchor(tarfile, doomed.end_offset, layout)
+	if abort_err != nil {
+		return
+	}
+	if moved_bytes > splice_max_moved {
+		// Moving that much in place takes about as long as rewriting.
+		return strategy, errCannotSplice
+	}
+	moved_members := make([]byte, moved_bytes)
+	if _, abort_err = tarfile.ReadAt(moved_members, doomed.end_offset); abort_err != nil {
+		return strategy, errorDuringOp{Path: tarfile.Name(), Op: "reading", Err: abort_err}
+	}
+	region_start := doomed.header_offset - doomed.header_offset%layout.alignment
+	scratch, abort_err := compose_region(tarfile, region_start, doomed.header_offset, nil, "", moved_members, layout, archive_progress)
+	if abort_err != nil {
+		return
+	}
+	defer scratch.Close()
+	if anchor == nil {
+		// Nothing aligned comes after it, so the tail can simply be moved down.
+		strategy = "truncated"
+		if moved_bytes > 0 {
+			strategy = "moved down"
+		}
+		if abort_err = finalize_tar(scratch); abort_err != nil {
+			return
+		}
+		file_end, seek_err := tarfile.Seek(0, io.SeekEnd)
+		if seek_err != nil {
+			return strategy, errorDuringOp{Path: tarfile.Name(), Op: "seek()", Err: seek_err}
+		}
+		return strategy, splice_region(tarfile, scratch, region_start, file_end, nil, archive_progress)
+	}
+
+	anchor_header_buf, abort_err := repad_header(anchor.header, tell(scratch), layout)
+	if abort_err != nil {
+		return
+	}
+	if _, abort_err = anchor_header_buf.WriteTo(scratch); abort_err != nil {
+		return strategy, errorDuringOp{Path: scratch.Name(), Op: "writing", Err: abort_err}
+	}
+	new_body_offset := region_start + tell(scratch)
+	if new_body_offset%layout.alignment != 0 || new_body_offset > anchor.body_offset {
+		return strategy, errCannotSplice
+	}
+	return "collapsed", splice_region(tarfile, scratch, region_start, anchor.body_offset, anchor, archive_progress)
+}
+
+func find_anchor(tarfile *os.File, start_offset int64, layout *archiveLayout) (anchor *archiveMember, moved_bytes int64, archive_end int64, abort_err error) {
+	// Finds the first member from start_offset onwards with an aligned body. The members before it (moved_bytes in
+	// total) don't care about alignment and can be moved around freely. Without such a member, anchor is nil.
+	archive_end, abort_err = index_archive(tarfile, start_offset, func(member *archiveMember) error {
+		if is_anchor(member, layout) {
+			anchor = member
+			return errStopIndexing
+		}
+		moved_bytes += member.end_offset - member.header_offset
+		return nil
+	})
+	if errors.Is(abort_err, errStopIndexing) {
+		abort_err = nil
+	}
+	return
+}
+
+func repad_header(header *tar.Header, header_offset int64, layout *archiveLayout) (header_buffer *bytes.Buffer, abort_err error) {
+	// Re-encodes the header of an existing member so that its body will start on an alignment boundary.
+	reheader := detach_header(header)
+	if abort_err = tar.NewWriter(io.Discard).WriteHeader(reheader); abort_err != nil {
+		return nil, errorDuringOp{Path: header.Name, Op: "WriteHeader", Err: abort_err}
+	}
+	_, header_buffer = pad_tarheader(reheader, header_offset, layout.alignment)
+	return
+}
+
+func rewrite_archive(tarfile *os.File, layout *archiveLayout, emit func(newfile *os.File, member *archiveMember) error) (abort_err error) {
+	// Writes a new archive next to the old one, then puts it in its place. For every member of the old archive, emit() decides
+	// what goes into the new one; typically that's the member itself, with its body cloned out of the old archive.
+	// The old archive's layout header is replaced by one of its own. The new archive keeps the permissions and owner
+	// of the old one.
+	output, abort_err := create_archive(tarfile.Name())
+	if abort_err != nil {
+		return
+	}
+	defer discard_archive(output)
+	newfile := output.file
+	if abort_err = write_layout_header(newfile, layout); abort_err != nil {
+		return
+	}
+	if _, abort_err = index_archive(tarfile, 0, func(member *archiveMember) error {
+		if is_layout_header(member.header) {
+			return nil
+		}
+		return emit(newfile, member)
+	}); abort_err != nil {
+		return
+	}
+	if abort_err = finalize_tar(newfile); abort_err != nil {
+		return
+	}
+	return commit_archive(output)
+}
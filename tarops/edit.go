@@ -0,0 +1,166 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type MemberEdit struct {
+	// Fields left nil are left as they are.
+	Name    *string
+	Mode    *int64
+	Uid     *int
+	Uname   *string
+	Gid     *int
+	Gname   *string
+	ModTime *time.Time
+}
+
+type headerDoesNotFit struct {
+	Path     string
+	Needed   int
+	Capacity int64
+}
+
+func (e headerDoesNotFit) Error() string {
+	return fmt.Sprintf("Edited header of '%s' does not fit in place: needs %d bytes, has room for %d", e.Path, e.Needed, e.Capacity)
+}
+
+func pad_tarheader_to(header *tar.Header, length int64) (header_buffer *bytes.Buffer, fits bool) {
+	// Encodes the header so that it's exactly length bytes long, by using a padding PAX record of just the right size.
+	// With every character added to the padding record the header grows by (at most) one tar block, so any
+	// block-multiple length can be hit, as long as it's no smaller than the header with a minimal padding record.
+	encode := func(padding_length int) *bytes.Buffer {
+		var buf bytes.Buffer
+		if padding_length > 0 {
+			header.PAXRecords[pax_padding_headerkey] = strings.Repeat(pax_filler_char, padding_length)
+		} else {
+			delete(header.PAXRecords, pax_padding_headerkey)
+		}
+		if ouch := tar.NewWriter(&buf).WriteHeader(header); ouch != nil {
+			return nil
+		}
+		return &buf
+	}
+	padded_records := make(map[string]string, len(header.PAXRecords)+1)
+	for key, value := range header.PAXRecords {
+		padded_records[key] = value
+	}
+	header.PAXRecords = padded_records
+
+	if pristine := encode(0); pristine == nil || int64(pristine.Len()) >= length {
+		return pristine, pristine != nil && int64(pristine.Len()) == length
+	}
+	padding_length := sort.Search(int(length), func(padding_length int) bool {
+		buf := encode(padding_length + 1)
+		return buf == nil || int64(buf.Len()) >= length
+	}) + 1
+	header_buffer = encode(padding_length)
+	return header_buffer, header_buffer != nil && int64(header_buffer.Len()) == length
+}
+
+func rename_member(name string, pattern string, new_name string) string {
+	// Renames the member that matched the pattern, or the part of its path that did if it's inside a matched directory.
+	is_dir := strings.HasSuffix(name, "/")
+	renamed := strings.TrimSuffix(new_name, "/") + strings.TrimPrefix(strings.TrimSuffix(name, "/"), pattern)
+	if is_dir {
+		renamed += "/"
+	}
+	return renamed
+}
+
+func Edit(archive *string, patterns []string, edit *MemberEdit, archive_progress *(chan ProgressMessage)) (allgood bool, abort_err error) {
+	allgood = true
+	tarfile, abort_err := os.OpenFile(*archive, os.O_RDWR, 0)
+	if abort_err != nil {
+		return
+	}
+	defer tarfile.Close()
+
+	type rewrite struct {
+		member     archiveMember
+		new_header *bytes.Buffer
+	}
+	var rewrites []rewrite
+	found := make(map[string]bool)
+	// First see whether all edited headers fit, so that we either edit all members, or none.
+	if _, abort_err = index_archive(tarfile, 0, func(member *archiveMember) error {
+		pattern, is_match := member_matches(member.header.Name, patterns)
+		link_pattern, link_is_match := "", false
+		if member.header.Typeflag == tar.TypeLink && edit.Name != nil {
+			link_pattern, link_is_match = member_matches(member.header.Linkname, patterns)
+		}
+		if !is_match && !link_is_match {
+			return nil
+		}
+		if is_sparse(member.header) {
+			return errorDuringOp{Path: member.header.Name, Op: "editing", Err: fmt.Errorf("sparse members can't be edited in place")}
+		}
+		header := detach_header(member.header)
+		if is_match {
+			found[pattern] = true
+			apply_edit(header, pattern, edit)
+		}
+		if link_is_match {
+			// A hardlink to a renamed member must follow suit
+			header.Linkname = rename_member(header.Linkname, link_pattern, *edit.Name)
+		}
+		capacity := member.body_offset - member.header_offset
+		header_buffer, fits := pad_tarheader_to(header, capacity)
+		if !fits {
+			needed := 0
+			if header_buffer != nil {
+				needed = header_buffer.Len()
+			}
+			return headerDoesNotFit{Path: member.header.Name, Needed: needed, Capacity: capacity}
+		}
+		rewrites = append(rewrites, rewrite{member: *member, new_header: header_buffer})
+		return nil
+	}); abort_err != nil {
+		return
+	}
+	for _, pattern := range patterns {
+		if !found[strings.TrimSuffix(pattern, "/")] {
+			warning_message(archive_progress, fmt.Sprintf("Not found in archive: %s", pattern))
+			allgood = false
+		}
+	}
+
+	for _, rewrite := range rewrites {
+		if _, abort_err = tarfile.WriteAt(rewrite.new_header.Bytes(), rewrite.member.header_offset); abort_err != nil {
+			return allgood, errorDuringOp{Path: tarfile.Name(), Op: "writing", Err: abort_err}
+		}
+		verbose_message(archive_progress, fmt.Sprintf("%-14s\t%s", "edited", rewrite.member.header.Name))
+	}
+	return
+}
+
+func apply_edit(header *tar.Header, pattern string, edit *MemberEdit) {
+	if edit.Name != nil {
+		header.Name = rename_member(header.Name, pattern, *edit.Name)
+	}
+	if edit.Mode != nil {
+		header.Mode = *edit.Mode
+	}
+	if edit.Uid != nil {
+		header.Uid = *edit.Uid
+	}
+	if edit.Uname != nil {
+		header.Uname = *edit.Uname
+	}
+	if edit.Gid != nil {
+		header.Gid = *edit.Gid
+	}
+	if edit.Gname != nil {
+		header.Gname = *edit.Gname
+	}
+	if edit.ModTime != nil {
+		header.ModTime = *edit.ModTime
+	}
+}
@@ -0,0 +1,143 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	cachedir_tagname   = "CACHEDIR.TAG"
+	cachedir_signature = "Signature: 8a477f597d28d172789f06886806bc55" // see https://bford.info/cachedir/
+)
+
+func glob_to_regexp(pattern string) string {
+	// Translates a shell-style glob into a regular expression. As with GNU tar's excludes, wildcards match '/' too.
+	var re strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '[':
+			class, class_end := glob_class_to_regexp(pattern, i)
+			if class_end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			re.WriteString(class)
+			i = class_end
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	return re.String()
+}
+
+func glob_class_to_regexp(pattern string, start int) (class string, class_end int) {
+	// Translates the bracket expression at pattern[start], such as [!a-z] or [[:digit:]_], into a regular expression
+	// character class. class_end is the index of the closing ']', or -1 if there's none, in which case the '[' is literal.
+	var re strings.Builder
+	re.WriteByte('[')
+	i := start + 1
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		re.WriteByte('^')
+		i++
+	}
+	for first := true; i < len(pattern); first = false {
+		c := pattern[i]
+		if c == ']' && !first {
+			re.WriteByte(']')
+			return re.String(), i
+		}
+		if c == '[' && i+1 < len(pattern) && pattern[i+1] == ':' {
+			// A named class, such as [:alpha:], is taken as is
+			if name_end := strings.Index(pattern[i+2:], ":]"); name_end >= 0 {
+				re.WriteString(pattern[i : i+2+name_end+2])
+				i += 2 + name_end + 2
+				continue
+			}
+		}
+		escaped := c == '\\' && i+1 < len(pattern)
+		if escaped {
+			i++
+			c = pattern[i]
+		}
+		if strings.IndexByte(`\[]^`, c) >= 0 || (c == '-' && escaped) {
+			re.WriteByte('\\')
+		}
+		re.WriteByte(c)
+		i++
+	}
+	return "", -1
+}
+
+func compile_excludes(patterns []string, anchored bool) (excludes []*regexp.Regexp, abort_err error) {
+	// An exclude pattern matches a member if it matches its name, or one of its leading directories.
+	// Unless anchored, the pattern may also match starting after any '/' in the name.
+	start := `^(?:.*/)?`
+	if anchored {
+		start = `^`
+	}
+	for _, pattern := range patterns {
+		exclude, compile_err := regexp.Compile(`(?s)` + start + `(?:` + glob_to_regexp(strings.TrimSuffix(pattern, "/")) + `)(?:/.*)?$`)
+		if compile_err != nil {
+			return nil, errorDuringOp{Path: pattern, Op: "parsing exclude pattern", Err: compile_err}
+		}
+		excludes = append(excludes, exclude)
+	}
+	return
+}
+
+func is_excluded(name string, excludes []*regexp.Regexp) bool {
+	for _, exclude := range excludes {
+		if exclude.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func is_newer(unixstat *syscall.Stat_t, options *ArchiveOptions) bool {
+	// Whether a file passes the --newer and --newer-mtime criteria
+	mtime := time.Unix(unixstat.Mtim.Unix())
+	if options.NewerMtime != nil && mtime.Before(*options.NewerMtime) {
+		return false
+	}
+	if options.Newer != nil && mtime.Before(*options.Newer) && time.Unix(unixstat.Ctim.Unix()).Before(*options.Newer) {
+		return false
+	}
+	return true
+}
+
+func is_cachedir(dirpath string, files []os.DirEntry) bool {
+	// Whether the directory holds a CACHEDIR.TAG file that starts with the proper signature.
+	for _, file := range files {
+		if file.Name() != cachedir_tagname || !file.Type().IsRegular() {
+			continue
+		}
+		tagfile, err := os.Open(filepath.Join(dirpath, cachedir_tagname))
+		if err != nil {
+			return false
+		}
+		defer tagfile.Close()
+		signature := make([]byte, len(cachedir_signature))
+		if _, err = io.ReadFull(tagfile, signature); err != nil {
+			return false
+		}
+		return bytes.Equal(signature, []byte(cachedir_signature))
+	}
+	return false
+}
@@ -8,22 +8,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
-func copyrange_from_archive(src_fd int, src_offset int64, len int, dst_fd int, dst_offset int64, full_path string) error {
-	written, copy_err := unix.CopyFileRange(src_fd, &src_offset, dst_fd, &dst_offset, len, 0)
-	if written != len {
-		return fmt.Errorf(error_writesize, "writing", full_path, written, len)
-	}
-	if copy_err != nil {
-		return errorDuringOp{Path: full_path, Op: "copy_file_range()", Err: copy_err}
-	}
-	return nil
-}
-
 func getdirhandle(basedir_handle int, path string) (dirhandle int, err error) {
 	dirhandle, err = unix.Openat2(basedir_handle, path, &openat_chroot_thatshow)
 	if err != nil {
@@ -53,7 +43,40 @@ func makedev(maj uint, min uint) (packeddev uint64) {
 		((uint64(maj) & ^uint64(0xfff)) << 32)
 }
 
-func extract_one(extractdir_fd int, full_path *string, header *tar.Header, tarfile *os.File, tar_reader *tar.Reader, dir_timestamps *map[string][]unix.Timeval, same_owner *bool) (was_cloned bool, abort_err error) {
+type ExtractOptions struct {
+	SameOwner bool // set file ownership as recorded in the archive
+	Freakout  bool // stop at the first error, rather than warning about it and carrying on
+	Fflags    bool // restore file flags (chattr attributes)
+	XattrOptions
+}
+
+func extract_body(outfile_handle int, header *tar.Header, tarfile *os.File, tar_reader *tar.Reader, block_size int64, full_path string, archive_progress *(chan ProgressMessage)) (was_cloned bool, is_nocow_blocked bool, abort_err error) {
+	// is_nocow_blocked tells whether the body could have been cloned, if the file hadn't been NOCOW.
+	tar_pos := tell(tarfile)
+	if is_sparse(header) {
+		// The body holds a sparse map and the data fragments, rather than the file's data as is
+		return was_cloned, false, extract_sparse(outfile_handle, tar_reader, header.Size, full_path)
+	}
+	// Leftovers, not making up a full block, are copied
+	page_spill := header.Size % block_size
+	if clone_length := header.Size - page_spill; tar_pos%block_size == 0 && clone_length > 0 {
+		// ficloneable, unless NOCOW (which it may have inherited from its directory); those can't share data with the archive
+		if is_nocow_blocked = is_nocow(outfile_handle); !is_nocow_blocked {
+			if was_cloned, abort_err = clone_range(int(tarfile.Fd()), tar_pos, clone_length, outfile_handle, 0, full_path, archive_progress); abort_err != nil {
+				return
+			}
+		}
+	}
+	if was_cloned {
+		if page_spill > 0 {
+			abort_err = copy_range(int(tarfile.Fd()), tar_pos+header.Size-page_spill, page_spill, outfile_handle, header.Size-page_spill, full_path, archive_progress)
+		}
+		return
+	}
+	return was_cloned, is_nocow_blocked, copy_range(int(tarfile.Fd()), tar_pos, header.Size, outfile_handle, 0, full_path, archive_progress)
+}
+
+func extract_one(extractdir_fd int, full_path *string, header *tar.Header, tarfile *os.File, tar_reader *tar.Reader, block_size int64, dir_timestamps *map[string][]unix.Timeval, deferred_fflags *map[string]uint32, nocow_dirs *map[string]bool, options *ExtractOptions, archive_progress *(chan ProgressMessage)) (was_cloned bool, abort_err error) {
 	destfile_dirhandle, abort_err := getdirhandle(extractdir_fd, filepath.Dir(filepath.Clean(header.Name)))
 	if abort_err != nil {
 		return
@@ -70,42 +93,35 @@ func extract_one(extractdir_fd int, full_path *string, header *tar.Header, tarfi
 
 	var outfile_handle int
 	var extra_openflags int
+	var metadata_err error // reported once the member is otherwise done
+	var fflags uint32
+	if options.Fflags && (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeGNUSparse || header.Typeflag == tar.TypeDir) {
+		fflags = parse_fflags(header.PAXRecords[pax_fflags_key])
+	}
 	switch header.Typeflag {
-	case tar.TypeReg:
+	case tar.TypeReg, tar.TypeGNUSparse:
 		var openat_err error
 		outfile_handle, openat_err = unix.Openat(destfile_dirhandle, thing_basename, os.O_EXCL|os.O_CREATE|unix.O_WRONLY|unix.O_LARGEFILE|unix.AT_SYMLINK_NOFOLLOW, uint32(header.Mode))
 		if openat_err != nil {
 			return was_cloned, errorDuringOp{Path: *full_path, Op: "openat()", Err: openat_err}
 		}
-		tar_pos := tell(tarfile)
-		if tar_pos%FS_PAGESIZE == 0 {
-			// ficloneable
-			page_spill := header.Size % FS_PAGESIZE // Leftovers, not making up a full page
-			ficlonerange := unix.FileCloneRange{
-				Src_fd:      int64(tarfile.Fd()),
-				Src_offset:  uint64(tar_pos),
-				Src_length:  uint64(header.Size) - uint64(page_spill),
-				Dest_offset: 0,
-			}
-			clone_err := unix.IoctlFileCloneRange(outfile_handle, &ficlonerange)
-			if clone_err != nil {
-				if errors.Is(clone_err, syscall.EXDEV) {
-					// ficlone cross-device not possible, copyrange instead
-					copyrange_from_archive(int(tarfile.Fd()), tar_pos, int(header.Size), outfile_handle, 0, *full_path)
-				} else {
-					return was_cloned, errorDuringOp{Path: *full_path, Op: "ficlone", Err: clone_err}
-				}
-			} else {
-				if page_spill > 0 {
-					// Still some stuff left to copy
-					copyrange_from_archive(int(tarfile.Fd()), tar_pos, int(page_spill), outfile_handle, header.Size-page_spill, *full_path)
-				}
-				was_cloned = true
-			}
-		} else {
-			copyrange_from_archive(int(tarfile.Fd()), tar_pos, int(header.Size), outfile_handle, 0, *full_path)
+		if fflags&fflags_before_data != 0 {
+			metadata_err = restore_fflags(outfile_handle, *full_path, fflags&fflags_before_data)
+		}
+		var is_nocow_blocked bool
+		if was_cloned, is_nocow_blocked, abort_err = extract_body(outfile_handle, header, tarfile, tar_reader, block_size, *full_path, archive_progress); abort_err != nil {
+			unix.Close(outfile_handle)
+			return
+		}
+		if parent_dir := filepath.Dir(*full_path); is_nocow_blocked && fflags&FS_NOCOW_FL == 0 && !(*nocow_dirs)[parent_dir] {
+			// Not NOCOW by the archive's say-so, so it inherited that from its directory
+			(*nocow_dirs)[parent_dir] = true
+			warn_nocow_dir(parent_dir, archive_progress)
+		}
+		if err := unix.Fsync(outfile_handle); err != nil {
+			unix.Close(outfile_handle)
+			return was_cloned, errorDuringOp{Path: *full_path, Op: "fsync()", Err: err}
 		}
-		unix.Fsync(outfile_handle)
 	case tar.TypeDir:
 		if err := unix.Mkdirat(destfile_dirhandle, thing_basename, uint32(header.Mode)); err != nil {
 			return was_cloned, errorDuringOp{Path: *full_path, Op: "mkdirat()", Err: err}
@@ -151,12 +167,15 @@ func extract_one(extractdir_fd int, full_path *string, header *tar.Header, tarfi
 		// - we cannot get a file descriptor for a symlink to apply Fchown & Futimes to :-(,
 		// - there's no chmodding a symlink
 		// - and other variants of calls are required to not dereference them
-		if *same_owner {
+		if options.SameOwner {
 			unix.Fchownat(destfile_dirhandle, thing_basename, header.Uid, header.Gid, unix.AT_SYMLINK_NOFOLLOW)
 			if err := unix.Lchown(*full_path, header.Uid, header.Gid); err != nil {
 				return was_cloned, errorDuringOp{Path: *full_path, Op: "chown()", Err: err}
 			}
 		}
+		if options.Xattrs {
+			metadata_err = restore_xattrs(0, *full_path, header, &options.XattrOptions)
+		}
 		unix.Lutimes(*full_path, timestamp)
 	} else {
 		// if we don't have a handle yet (if the FS entity cannot be created through openat2 - eg anything but an ordinary file),
@@ -167,16 +186,41 @@ func extract_one(extractdir_fd int, full_path *string, header *tar.Header, tarfi
 			if openat_err != nil {
 				return was_cloned, errorDuringOp{Path: *full_path, Op: "reopening", Err: openat_err}
 			}
+			if header.Typeflag == tar.TypeDir && fflags&fflags_before_data != 0 {
+				// Set before anything is created in the directory, so that it's inherited
+				metadata_err = restore_fflags(outfile_handle, *full_path, fflags&fflags_before_data)
+			}
 		}
 		if err := unix.Fchmod(outfile_handle, uint32(header.Mode)); err != nil {
 			return was_cloned, errorDuringOp{Path: *full_path, Op: "fchmod()", Err: err}
 		}
-		if *same_owner {
+		if options.SameOwner {
 			if err := unix.Fchown(outfile_handle, header.Uid, header.Gid); err != nil {
 				return was_cloned, errorDuringOp{Path: *full_path, Op: "fchown()", Err: err}
 			}
 		}
+		if options.Xattrs && header.Typeflag != tar.TypeLink {
+			// Only now that the owner has been set, as chown() clears file capabilities
+			if xattrs_err := restore_xattrs(outfile_handle, *full_path, header, &options.XattrOptions); metadata_err == nil {
+				metadata_err = xattrs_err
+			}
+		}
 		unix.Futimes(outfile_handle, timestamp)
+		if header.Typeflag == tar.TypeDir && fflags != 0 {
+			// Flags such as immutable would keep us from extracting the directory's contents
+			(*deferred_fflags)[filepath.Clean(header.Name)] = fflags
+		} else if fflags != 0 {
+			// Last, as the immutable and append-only flags don't allow for setting any metadata afterwards. Those
+			// two wait until extraction is done, as they'd keep hardlinks to this file from being extracted, too.
+			if fflags&fflags_after_links != 0 {
+				(*deferred_fflags)[filepath.Clean(header.Name)] = fflags & fflags_after_links
+			}
+			if fflags&^fflags_after_links != 0 {
+				if fflags_err := restore_fflags(outfile_handle, *full_path, fflags&^fflags_after_links); metadata_err == nil {
+					metadata_err = fflags_err
+				}
+			}
+		}
 		unix.Close(outfile_handle)
 	}
 
@@ -193,21 +237,44 @@ func extract_one(extractdir_fd int, full_path *string, header *tar.Header, tarfi
 	}
 
 	unix.Close(destfile_dirhandle)
-	return was_cloned, nil
+	return was_cloned, metadata_err
 }
 
-func Extract(extractdir string, tarfile *os.File, same_owner *bool, freakout *bool, archive_progress *(chan ProgressMessage), offset uint) (allgood bool, abort_err error) {
+func warn_nocow_dir(dirpath string, archive_progress *(chan ProgressMessage)) {
+	warning_message(archive_progress, fmt.Sprintf("'%s' has the NOCOW attribute (chattr +C), which files extracted into it inherit; those can't be cloned, only copied.", dirpath))
+}
+
+func Extract(extractdir string, tarfile *os.File, options *ExtractOptions, archive_progress *(chan ProgressMessage), offset uint) (allgood bool, abort_err error) {
+	if abort_err = validate_xattr_patterns(&options.XattrOptions); abort_err != nil {
+		return
+	}
 	if (offset != 0) {
 		tarfile.Seek(int64(offset), os.SEEK_SET)
 	}
+	// Bodies can be cloned out if they're aligned to the blocks of the archive's filesystem, whatever alignment the
+	// archive was laid out with.
+	block_size := fs_block_size(tarfile)
+	if alignment, is_recorded := recorded_alignment(tarfile, int64(offset)); is_recorded && alignment%block_size != 0 {
+		warning_message(archive_progress, fmt.Sprintf("'%s' was laid out with %d-byte alignment, but its filesystem clones in blocks of %d bytes; most members can't be cloned out, only copied.", tarfile.Name(), alignment, block_size))
+	}
 	tar_reader := tar.NewReader(tarfile)
 	dir_timestamps := make(map[string][]unix.Timeval)
+	deferred_fflags := make(map[string]uint32)
+	nocow_dirs := make(map[string]bool) // directories that have been warned about
 	allgood = true
 	extractdir_fd, err := unix.Openat(unix.AT_FDCWD, extractdir, unix.O_PATH|unix.O_DIRECTORY, 0)
 	if err != nil {
 		abort_err = errorDuringOp{Path: extractdir, Op: "openat()", Err: err}
 		return
 	}
+	if extractdir_readable_fd, err := unix.Open(extractdir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0); err == nil {
+		if is_nocow(extractdir_readable_fd) {
+			// Said up front, as that goes for the whole extraction. Subdirectories are warned about as their files turn out NOCOW.
+			nocow_dirs[filepath.Clean(extractdir)] = true
+			warn_nocow_dir(extractdir, archive_progress)
+		}
+		unix.Close(extractdir_readable_fd)
+	}
 
 records_loop:
 	for {
@@ -219,11 +286,15 @@ records_loop:
 			abort_err = errorDuringOp{Path: tarfile.Name(), Op: "Next()", Err: err}
 			return
 		}
+		if is_layout_header(header) {
+			// Describes the archive, not a file to extract
+			continue
+		}
 		full_path := filepath.Clean(filepath.Join(extractdir, header.Name))
 
-		was_cloned, extract_err := extract_one(extractdir_fd, &full_path, header, tarfile, tar_reader, &dir_timestamps, same_owner)
+		was_cloned, extract_err := extract_one(extractdir_fd, &full_path, header, tarfile, tar_reader, block_size, &dir_timestamps, &deferred_fflags, &nocow_dirs, options, archive_progress)
 
-		if !*freakout {
+		if !options.Freakout {
 			var unhandledRecordErr unhandledRecord
 			if errors.As(extract_err, &unhandledRecordErr) {
 				warning_message(archive_progress, fmt.Sprintf("Skipping: %v", unhandledRecordErr))
@@ -236,6 +307,16 @@ records_loop:
 				allgood = false
 				continue records_loop
 			}
+			var unrestoredMetadataErr unrestoredMetadata
+			if errors.As(extract_err, &unrestoredMetadataErr) {
+				warning_message(archive_progress, unrestoredMetadataErr.Error())
+				allgood = false
+			} else if extract_err != nil {
+				// Such as running out of space while writing out the data
+				warning_message(archive_progress, extract_err.Error())
+				allgood = false
+				continue records_loop
+			}
 		} else {
 			if extract_err != nil {
 				abort_err = extract_err
@@ -251,5 +332,29 @@ records_loop:
 		}
 		verbose_message(archive_progress, fmt.Sprintf("%-15s\t%s", recordtype, header.Name))
 	}
+
+	// Now that the directories have been filled, and the hardlinks made, things can be made immutable and such.
+	deferred_names := make([]string, 0, len(deferred_fflags))
+	for name := range deferred_fflags {
+		deferred_names = append(deferred_names, name)
+	}
+	sort.Strings(deferred_names)
+	for _, name := range deferred_names {
+		full_path := filepath.Join(extractdir, name)
+		var fflags_err error
+		if fd, open_err := unix.Openat2(extractdir_fd, name, &unix.OpenHow{Flags: unix.O_RDONLY | unix.O_NOFOLLOW | unix.O_NONBLOCK | unix.O_CLOEXEC, Resolve: openat_chroot_thatshow.Resolve}); open_err != nil {
+			fflags_err = unrestoredMetadata{Path: full_path, What: "file flags", Err: open_err}
+		} else {
+			fflags_err = restore_fflags(fd, full_path, deferred_fflags[name])
+			unix.Close(fd)
+		}
+		if fflags_err != nil {
+			if options.Freakout {
+				return allgood, fflags_err
+			}
+			warning_message(archive_progress, fflags_err.Error())
+			allgood = false
+		}
+	}
 	return
 }
@@ -0,0 +1,124 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"archive/tar"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Inode flags from linux/fs.h, as set with chattr(1); not in x/sys/unix
+	FS_SECRM_FL        = 0x00000001
+	FS_UNRM_FL         = 0x00000002
+	FS_COMPR_FL        = 0x00000004
+	FS_SYNC_FL         = 0x00000008
+	FS_IMMUTABLE_FL    = 0x00000010
+	FS_APPEND_FL       = 0x00000020
+	FS_NODUMP_FL       = 0x00000040
+	FS_NOATIME_FL      = 0x00000080
+	FS_JOURNAL_DATA_FL = 0x00004000
+	FS_NOTAIL_FL       = 0x00008000
+	FS_DIRSYNC_FL      = 0x00010000
+	FS_TOPDIR_FL       = 0x00020000
+	FS_NOCOW_FL        = 0x00800000
+	FS_PROJINHERIT_FL  = 0x20000000
+
+	pax_fflags_key = "SCHILY.fflags" // as used by BSD tar and star
+
+	// These only take effect on files that have no data yet. For directories, they're inherited by what's created in them.
+	fflags_before_data = FS_NOCOW_FL | FS_COMPR_FL
+	// These keep hardlinks to a file from being made, so they're only set once extraction is done.
+	fflags_after_links = FS_IMMUTABLE_FL | FS_APPEND_FL
+)
+
+var fflag_names = []struct {
+	flag    uint32
+	name    string
+	aliases []string
+}{
+	// Named like BSD tar does on Linux
+	{FS_APPEND_FL, "sappnd", []string{"sappend"}},
+	{FS_IMMUTABLE_FL, "schg", []string{"simmutable", "sysimmutable"}},
+	{FS_NODUMP_FL, "nodump", nil},
+	{FS_COMPR_FL, "compress", nil},
+	{FS_NOATIME_FL, "noatime", nil},
+	{FS_NOCOW_FL, "nocow", nil},
+	{FS_SYNC_FL, "sync", nil},
+	{FS_DIRSYNC_FL, "dirsync", nil},
+	{FS_JOURNAL_DATA_FL, "journal-data", nil},
+	{FS_SECRM_FL, "secdel", nil},
+	{FS_UNRM_FL, "uunlink", nil},
+	{FS_NOTAIL_FL, "notail", nil},
+	{FS_TOPDIR_FL, "topdir", nil},
+	{FS_PROJINHERIT_FL, "projinherit", nil},
+}
+
+func format_fflags(flags uint32) string {
+	var names []string
+	for _, fflag := range fflag_names {
+		if flags&fflag.flag != 0 {
+			names = append(names, fflag.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func parse_fflags(formatted string) (flags uint32) {
+	// Names we don't know of (such as those of other operating systems) are ignored.
+	for _, name := range strings.Split(formatted, ",") {
+		for _, fflag := range fflag_names {
+			if name == fflag.name || slices.Contains(fflag.aliases, name) {
+				flags |= fflag.flag
+			}
+		}
+	}
+	return
+}
+
+func get_fsflags(inpath string) (flags uint32, err error) {
+	// Only meant for regular files and directories; opening anything else may have side effects.
+	fd, err := unix.Open(inpath, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	defer unix.Close(fd)
+	return unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+}
+
+func has_nodump_flag(inpath string) bool {
+	// Whether the file carries the nodump attribute. Filesystems that don't do attributes have none set.
+	flags, err := get_fsflags(inpath)
+	return err == nil && flags&FS_NODUMP_FL != 0
+}
+
+func is_nocow(fd int) bool {
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	return err == nil && flags&FS_NOCOW_FL != 0
+}
+
+func record_fflags(header *tar.Header, inpath string) {
+	// Filesystems that don't do attributes have none set, so failing to read them isn't an error.
+	if flags, err := get_fsflags(inpath); err == nil {
+		if formatted := format_fflags(flags); len(formatted) > 0 {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[pax_fflags_key] = formatted
+		}
+	}
+}
+
+func restore_fflags(fd int, full_path string, flags uint32) error {
+	// Adds to the flags the file has already, as some (such as the extent flag) aren't for us to clear.
+	current, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err == nil && current|flags != current {
+		err = unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(current|flags))
+	}
+	if err != nil {
+		return unrestoredMetadata{Path: full_path, What: "file flags " + format_fflags(flags), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+type memberSelector struct {
+	pattern  string
+	new_name string // if empty, matched members keep their name
+}
+
+func parse_selectors(specs []string) (selectors []memberSelector, abort_err error) {
+	for _, spec := range specs {
+		pattern, new_name, _ := strings.Cut(spec, "=")
+		pattern = strings.TrimSuffix(pattern, "/")
+		if _, abort_err = path.Match(pattern, ""); abort_err != nil {
+			return nil, errorDuringOp{Path: spec, Op: "parsing selector", Err: abort_err}
+		}
+		selectors = append(selectors, memberSelector{pattern: pattern, new_name: new_name})
+	}
+	return
+}
+
+func select_member(name string, selectors []memberSelector) (selector *memberSelector, new_name string) {
+	// As in GNU tar, a pattern selects a member if it matches its name, or any of its leading directories.
+	// If the selector renames, the matched (shortest) leading part of the name is replaced.
+	is_dir := strings.HasSuffix(name, "/")
+	trimmed_name := strings.TrimSuffix(name, "/")
+	for i := range selectors {
+		for leading_end := 0; leading_end < len(trimmed_name); {
+			next_slash := strings.IndexByte(trimmed_name[leading_end+1:], '/')
+			if next_slash < 0 {
+				leading_end = len(trimmed_name)
+			} else {
+				leading_end += 1 + next_slash
+			}
+			if matched, _ := path.Match(selectors[i].pattern, trimmed_name[:leading_end]); !matched {
+				continue
+			}
+			if len(selectors[i].new_name) == 0 {
+				return &selectors[i], name
+			}
+			new_name = strings.TrimSuffix(selectors[i].new_name, "/") + trimmed_name[leading_end:]
+			if is_dir {
+				new_name += "/"
+			}
+			return &selectors[i], new_name
+		}
+	}
+	return nil, ""
+}
+
+func Filter(src_archive *string, dst_archive *string, selector_specs []string, layout_options *LayoutOptions, archive_progress *(chan ProgressMessage)) (allgood bool, abort_err error) {
+	allgood = true
+	selectors, abort_err := parse_selectors(selector_specs)
+	if abort_err != nil {
+		return
+	}
+	srcfile, abort_err := os.Open(*src_archive)
+	if abort_err != nil {
+		return
+	}
+	defer srcfile.Close()
+	return filter_archive(srcfile, dst_archive, selectors, selector_specs, layout_options, archive_progress)
+}
+
+func filter_archive(srcfile *os.File, dst_archive *string, selectors []memberSelector, selector_specs []string, layout_options *LayoutOptions, archive_progress *(chan ProgressMessage)) (allgood bool, abort_err error) {
+	// Without any selectors, every member is copied over.
+	allgood = true
+	if dst_stat, stat_err := os.Stat(*dst_archive); stat_err == nil {
+		if src_stat, stat_err := srcfile.Stat(); stat_err == nil && os.SameFile(src_stat, dst_stat) {
+			return allgood, errorDuringOp{Path: *dst_archive, Op: "filtering", Err: fmt.Errorf("input and output archive are the same file")}
+		}
+	}
+	output, abort_err := create_archive(*dst_archive)
+	if abort_err != nil {
+		return
+	}
+	defer discard_archive(output)
+	outfile := output.file
+	layout, abort_err := archive_layout(outfile, layout_options)
+	if abort_err != nil {
+		return
+	}
+	if abort_err = write_layout_header(outfile, layout); abort_err != nil {
+		return
+	}
+
+	seen_members := make(map[string]archiveMember) // by original name
+	new_names := make(map[string]string)           // original name → name in the output, for members that were selected
+	promoted_names := make(map[string]string)      // original name of a filtered out hardlink target → name of the hardlink that took its place
+	used_selectors := make(map[*memberSelector]bool)
+	if _, abort_err = index_archive(srcfile, 0, func(member *archiveMember) error {
+		if is_layout_header(member.header) {
+			return nil
+		}
+		seen_members[member.header.Name] = *member
+		transplantee := *member
+		if len(selectors) > 0 {
+			selector, new_name := select_member(member.header.Name, selectors)
+			if selector == nil {
+				return nil
+			}
+			used_selectors[selector] = true
+			if new_name != member.header.Name {
+				renamed_header := *member.header
+				renamed_header.Name = new_name
+				transplantee.header = &renamed_header
+			}
+		}
+		new_names[member.header.Name] = transplantee.header.Name
+		if transplantee.header.Typeflag == tar.TypeLink {
+			if linked_name, link_target_selected := new_names[transplantee.header.Linkname]; link_target_selected {
+				linking_header := *transplantee.header
+				linking_header.Linkname = linked_name
+				transplantee.header = &linking_header
+			} else if target, is_present := seen_members[transplantee.header.Linkname]; is_present {
+				// The hardlink target was filtered out, so this member (or an earlier hardlink to it) gets to hold the data instead.
+				transplantee = promote_hardlink(transplantee, member.header.Name, &target, promoted_names)
+			} else {
+				warning_message(archive_progress, fmt.Sprintf("Hardlink target not in output archive: %s -> %s", transplantee.header.Name, transplantee.header.Linkname))
+				allgood = false
+			}
+		}
+		was_cloned, copy_err := copy_member(outfile, srcfile, &transplantee, layout, archive_progress)
+		if copy_err != nil {
+			return copy_err
+		}
+		var recordtype string
+		if was_cloned {
+			recordtype = "file (cloned)"
+		} else {
+			recordtype = humanize_tar_recordtype(transplantee.header.Typeflag)
+		}
+		verbose_message(archive_progress, fmt.Sprintf("%-14s\t%s", recordtype, transplantee.header.Name))
+		return nil
+	}); abort_err != nil {
+		return
+	}
+	for i := range selectors {
+		if !used_selectors[&selectors[i]] {
+			warning_message(archive_progress, fmt.Sprintf("Not found in archive: %s", selector_specs[i]))
+			allgood = false
+		}
+	}
+	if abort_err = finalize_tar(outfile); abort_err != nil {
+		return
+	}
+	report_layout(layout, archive_progress)
+	return allgood, commit_archive(output)
+}
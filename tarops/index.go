@@ -0,0 +1,98 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"strings"
+)
+
+type archiveMember struct {
+	header        *tar.Header
+	header_offset int64 // where the first (possibly PAX or GNU extension) header block of this member starts
+	body_offset   int64 // where the member's data starts
+	end_offset    int64 // where the member's data ends, including the padding out to the tar block size
+}
+
+func is_sparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func round_up(offset int64, boundary int64) int64 {
+	if overboundary := offset % boundary; overboundary > 0 {
+		return offset + boundary - overboundary
+	}
+	return offset
+}
+
+func index_archive(tarfile *os.File, start_offset int64, visit func(member *archiveMember) error) (archive_end int64, abort_err error) {
+	// Walks the members of an archive, noting where each one starts and ends. archive/tar doesn't tell us about offsets,
+	// but it doesn't buffer either, so the file position right after Next() is where the member's data starts.
+	// A fresh Reader is started at every member so that visit() is free to move the file position around.
+	pos := start_offset
+	for {
+		if _, abort_err = tarfile.Seek(pos, io.SeekStart); abort_err != nil {
+			return pos, errorDuringOp{Path: tarfile.Name(), Op: "seek()", Err: abort_err}
+		}
+		tar_reader := tar.NewReader(tarfile)
+		header, next_err := tar_reader.Next()
+		if next_err == io.EOF {
+			// End-of-archive marker, or simply the end of the file
+			return pos, nil
+		}
+		if next_err != nil {
+			return pos, errorDuringOp{Path: tarfile.Name(), Op: "Next()", Err: next_err}
+		}
+		member := archiveMember{header: header, header_offset: pos, body_offset: tell(tarfile)}
+		switch {
+		case is_sparse(header):
+			// archive/tar doesn't expose the stored (physical) size of sparse members, so it's taken from the raw header.
+			if member.end_offset, abort_err = stored_sparse_end(tarfile, &member); abort_err != nil {
+				return pos, abort_err
+			}
+		case header.Typeflag == tar.TypeXGlobalHeader:
+			// its records have been consumed by Next() already
+			member.end_offset = round_up(member.body_offset, TAR_BLOCKSIZE)
+		case has_body(header):
+			member.end_offset = round_up(member.body_offset+header.Size, TAR_BLOCKSIZE)
+		default:
+			member.end_offset = member.body_offset
+		}
+		if visit != nil {
+			if abort_err = visit(&member); abort_err != nil {
+				return
+			}
+		}
+		pos = member.end_offset
+	}
+}
+
+func open_member_body(tarfile *os.File, member *archiveMember) (body *tar.Reader, abort_err error) {
+	// Returns a Reader positioned at the start of the member's (logical) data, for when the body can't be taken by offset.
+	if _, abort_err = tarfile.Seek(member.header_offset, io.SeekStart); abort_err != nil {
+		return nil, errorDuringOp{Path: tarfile.Name(), Op: "seek()", Err: abort_err}
+	}
+	body = tar.NewReader(tarfile)
+	if _, abort_err = body.Next(); abort_err != nil {
+		return nil, errorDuringOp{Path: tarfile.Name(), Op: "Next()", Err: abort_err}
+	}
+	return
+}
+
+func has_body(header *tar.Header) bool {
+	switch header.Typeflag {
+	case tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,167 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const max_symlink_hops = 40 // like the kernel's
+
+type newArchive struct {
+	// An archive that's being written in a file of its own, which only takes the place of the archive at path once
+	// it's complete, so that a failed run doesn't leave a broken archive behind. A symlink at the path given is
+	// followed, so that it's the file it leads to that's replaced.
+	file      *os.File
+	path      string
+	temp_path string // the name of the file while it's being written, or empty for an O_TMPFILE, which has none yet
+	committed bool
+}
+
+var (
+	// What to undo to the archives being written, should the process be interrupted
+	undo_lock  sync.Mutex
+	undo_queue = make(map[*os.File]func())
+)
+
+func Interrupt() {
+	// To be called when the process is about to exit prematurely, such as upon SIGINT. Partially written archives are
+	// removed, and archives being appended to are restored to what they were. Afterwards, nothing will be committed
+	// anymore, so the process should exit without delay.
+	undo_lock.Lock()
+	for _, undo := range undo_queue {
+		undo()
+	}
+}
+
+func undo_on_interrupt(file *os.File, undo func()) {
+	undo_lock.Lock()
+	defer undo_lock.Unlock()
+	undo_queue[file] = undo
+}
+
+func forget_undo(file *os.File) {
+	undo_lock.Lock()
+	defer undo_lock.Unlock()
+	delete(undo_queue, file)
+}
+
+func temp_name_for(dst_path string) string {
+	return filepath.Join(filepath.Dir(dst_path), fmt.Sprintf(".deduptar-%d", rand.Uint32()))
+}
+
+func resolve_symlinks(dst_path string) (resolved string, abort_err error) {
+	// Follows symlinks to where they lead, also if that's nowhere yet, as opening the path for writing would.
+	resolved = dst_path
+	for hops := 0; ; hops++ {
+		target, readlink_err := os.Readlink(resolved)
+		if readlink_err != nil {
+			// Not a symlink, or nothing there; either way, that's where the archive goes.
+			return resolved, nil
+		} else if hops == max_symlink_hops {
+			return dst_path, errorDuringOp{Path: dst_path, Op: "resolving symlinks", Err: unix.ELOOP}
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(resolved), target)
+		}
+		resolved = target
+	}
+}
+
+func create_archive(dst_path string) (output *newArchive, abort_err error) {
+	// An O_TMPFILE vanishes by itself if we don't get to linking it, even if the process is killed off. Not all
+	// filesystems do those though, in which case a hidden file is used. Either is in the same directory as the
+	// archive it's going to replace, as it couldn't be renamed there otherwise.
+	if dst_path, abort_err = resolve_symlinks(dst_path); abort_err != nil {
+		return
+	}
+	output = &newArchive{path: dst_path}
+	if fd, open_err := unix.Open(filepath.Dir(dst_path), unix.O_TMPFILE|unix.O_RDWR|unix.O_CLOEXEC, 0666); open_err == nil {
+		output.file = os.NewFile(uintptr(fd), dst_path)
+		undo_on_interrupt(output.file, func() {})
+	} else if !errors.Is(open_err, unix.EOPNOTSUPP) && !errors.Is(open_err, unix.EISDIR) && !errors.Is(open_err, unix.EINVAL) {
+		return nil, errorDuringOp{Path: dst_path, Op: "open(O_TMPFILE)", Err: open_err}
+	} else {
+		for {
+			output.temp_path = temp_name_for(dst_path)
+			if output.file, abort_err = os.OpenFile(output.temp_path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666); !errors.Is(abort_err, os.ErrExist) {
+				break
+			}
+		}
+		if abort_err != nil {
+			return nil, abort_err
+		}
+		undo_on_interrupt(output.file, func() { os.Remove(output.temp_path) })
+	}
+	if abort_err = carry_over_attributes(output); abort_err != nil {
+		discard_archive(output)
+		return nil, abort_err
+	}
+	return
+}
+
+func carry_over_attributes(output *newArchive) error {
+	// The archive being replaced keeps its permissions, and its owner, as far as we get to give the new one away
+	// (which takes privileges). If there's none yet, the new one is created as usual.
+	existing, stat_err := os.Stat(output.path)
+	if stat_err != nil || !existing.Mode().IsRegular() {
+		return nil
+	}
+	if unixstat, is_unix := existing.Sys().(*syscall.Stat_t); is_unix {
+		output.file.Chown(int(unixstat.Uid), int(unixstat.Gid))
+	}
+	// After chown(), which clears the setuid and setgid bits
+	if err := output.file.Chmod(existing.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+		return errorDuringOp{Path: output.path, Op: "fchmod()", Err: err}
+	}
+	return nil
+}
+
+func commit_archive(output *newArchive) (abort_err error) {
+	// Puts the complete archive in place, replacing whatever was there.
+	if abort_err = output.file.Sync(); abort_err != nil {
+		return errorDuringOp{Path: output.path, Op: "fsync()", Err: abort_err}
+	}
+	undo_lock.Lock()
+	defer undo_lock.Unlock()
+	if len(output.temp_path) == 0 {
+		// An O_TMPFILE can only be linked to a new name, so it's given a temporary one first, which is then renamed.
+		for {
+			temp_path := temp_name_for(output.path)
+			link_err := unix.Linkat(int(output.file.Fd()), "", unix.AT_FDCWD, temp_path, unix.AT_EMPTY_PATH)
+			if errors.Is(link_err, unix.ENOENT) || errors.Is(link_err, unix.EPERM) {
+				// Linking by file descriptor takes privileges on older kernels; going through /proc doesn't.
+				link_err = unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", output.file.Fd()), unix.AT_FDCWD, temp_path, unix.AT_SYMLINK_FOLLOW)
+			}
+			if link_err == nil {
+				output.temp_path = temp_path
+				break
+			} else if !errors.Is(link_err, unix.EEXIST) {
+				return errorDuringOp{Path: output.path, Op: "linkat()", Err: link_err}
+			}
+		}
+	}
+	if abort_err = os.Rename(output.temp_path, output.path); abort_err != nil {
+		os.Remove(output.temp_path)
+		return
+	}
+	delete(undo_queue, output.file)
+	output.committed = true
+	return
+}
+
+func discard_archive(output *newArchive) {
+	// Closes the archive, and removes it unless it was committed.
+	forget_undo(output.file)
+	if !output.committed && len(output.temp_path) > 0 {
+		os.Remove(output.temp_path)
+	}
+	output.file.Close()
+}
@@ -0,0 +1,66 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+)
+
+func Realign(src_archive *string, dst_archive *string, layout_options *LayoutOptions, archive_progress *(chan ProgressMessage)) (allgood bool, abort_err error) {
+	// Rewrites any tar archive into the deduptar layout, so that its member bodies are aligned and will clone out.
+	// Bodies that happen to be aligned already are cloned, the rest is copied. An input of "-" reads from stdin.
+	if *src_archive != "-" {
+		return Filter(src_archive, dst_archive, nil, layout_options, archive_progress)
+	}
+	if stdin_stat, stat_err := os.Stdin.Stat(); stat_err == nil && stdin_stat.Mode().IsRegular() {
+		// Redirected from a file, so we can still seek around in it, and clone from it.
+		return filter_archive(os.Stdin, dst_archive, nil, nil, layout_options, archive_progress)
+	}
+	output, abort_err := create_archive(*dst_archive)
+	if abort_err != nil {
+		return false, abort_err
+	}
+	defer discard_archive(output)
+	layout, abort_err := archive_layout(output.file, layout_options)
+	if abort_err != nil {
+		return false, abort_err
+	}
+	if abort_err = realign_stream(os.Stdin, output.file, layout, archive_progress); abort_err != nil {
+		return false, abort_err
+	}
+	return true, commit_archive(output)
+}
+
+func realign_stream(infile io.Reader, outfile *os.File, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (abort_err error) {
+	if abort_err = write_layout_header(outfile, layout); abort_err != nil {
+		return
+	}
+	tar_reader := tar.NewReader(infile)
+	for {
+		original, next_err := tar_reader.Next()
+		if next_err == io.EOF {
+			break
+		} else if next_err != nil {
+			return errorDuringOp{Path: "-", Op: "reading archive", Err: next_err}
+		}
+		if is_layout_header(original) {
+			continue
+		}
+		header := detach_header(original)
+		if is_sparse(header) {
+			// The tar reader hands us the expanded data
+			unsparsify_header(header)
+		}
+		if abort_err = tarwrite_stream(outfile, header, tar_reader, layout); abort_err != nil {
+			return
+		}
+		verbose_message(archive_progress, fmt.Sprintf("%-14s\t%s", humanize_tar_recordtype(header.Typeflag), header.Name))
+	}
+	if abort_err = finalize_tar(outfile); abort_err != nil {
+		return
+	}
+	report_layout(layout, archive_progress)
+	return
+}
@@ -0,0 +1,288 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func Replace(archive *string, inpaths []string, follow_symlinks *bool, archive_progress *(chan ProgressMessage)) (abort_err error) {
+	tarfile, abort_err := os.OpenFile(*archive, os.O_RDWR, 0)
+	if abort_err != nil {
+		return
+	}
+	defer func() {
+		// which may not be the file we opened anymore, if the archive was rewritten
+		tarfile.Close()
+	}()
+	layout, abort_err := archive_layout(tarfile, nil)
+	if abort_err != nil {
+		return
+	}
+	members, archive_end, abort_err := reindex_members(tarfile, nil, 0, nil, 0, 0)
+	if abort_err != nil {
+		return
+	}
+
+	stripped_prefixes := make(map[string]bool)
+	for _, inpath := range inpaths {
+		header, _, header_err := make_header(inpath, strip_unsafe_prefix(filepath.Clean(inpath), stripped_prefixes, archive_progress), follow_symlinks)
+		if header_err != nil {
+			return header_err
+		}
+		// Upon extraction, the last member of a given name wins, so that's the one to replace.
+		var replacee *archiveMember
+		for i := len(members) - 1; i >= 0; i-- {
+			if strings.TrimSuffix(members[i].header.Name, "/") == strings.TrimSuffix(header.Name, "/") {
+				replacee = &members[i]
+				break
+			}
+		}
+		size_before, seek_err := tarfile.Seek(0, io.SeekEnd)
+		if seek_err != nil {
+			return errorDuringOp{Path: tarfile.Name(), Op: "seek()", Err: seek_err}
+		}
+
+		var strategy string
+		var anchor *archiveMember
+		var replace_err error
+		splice_offset := archive_end
+		if replacee == nil {
+			strategy = "appended"
+			replace_err = rewrite_tail(tarfile, archive_end, header, inpath, nil, layout, archive_progress)
+		} else {
+			splice_offset = replacee.header_offset
+			strategy, anchor, replace_err = replace_in_place(tarfile, replacee, header, inpath, layout, archive_progress)
+		}
+		if replacee != nil && errors.Is(replace_err, errCannotSplice) {
+			strategy = "rewritten"
+			strip_padding(header)
+			replace_err = rewrite_archive(tarfile, layout, func(newfile *os.File, member *archiveMember) (emit_err error) {
+				if member.header_offset == replacee.header_offset {
+					_, emit_err = tarwrite(newfile, header, inpath, layout, false, archive_progress)
+				} else {
+					_, emit_err = copy_member(newfile, tarfile, member, layout, archive_progress)
+				}
+				return
+			})
+			if replace_err == nil {
+				// The archive we had open has been replaced by the rewritten one, which needs indexing all over.
+				tarfile.Close()
+				if tarfile, replace_err = os.OpenFile(*archive, os.O_RDWR, 0); replace_err != nil {
+					return replace_err
+				}
+				members, splice_offset, anchor = nil, 0, nil
+			}
+		}
+		if replace_err != nil {
+			return replace_err
+		}
+		verbose_message(archive_progress, fmt.Sprintf("%-14s\t%s", strategy, header.Name))
+		size_after, seek_err := tarfile.Seek(0, io.SeekEnd)
+		if seek_err != nil {
+			return errorDuringOp{Path: tarfile.Name(), Op: "seek()", Err: seek_err}
+		}
+		if members, archive_end, abort_err = reindex_members(tarfile, members, splice_offset, anchor, size_after-size_before, archive_end); abort_err != nil {
+			return
+		}
+	}
+	return
+}
+
+func reindex_members(tarfile *os.File, members []archiveMember, from_offset int64, anchor *archiveMember, shift int64, archive_end int64) (reindexed []archiveMember, new_archive_end int64, abort_err error) {
+	// Brings the index of an archive up to date after it was changed from from_offset onwards. If that change moved
+	// an anchor along (by shift), everything after the anchor merely moved along with it, so indexing stops there.
+	kept := 0
+	for kept < len(members) && members[kept].header_offset < from_offset {
+		kept++
+	}
+	reindexed = append([]archiveMember(nil), members[:kept]...)
+	new_archive_end, abort_err = index_archive(tarfile, from_offset, func(member *archiveMember) error {
+		reindexed = append(reindexed, *member)
+		if anchor != nil && member.body_offset == anchor.body_offset+shift {
+			return errStopIndexing
+		}
+		return nil
+	})
+	if !errors.Is(abort_err, errStopIndexing) {
+		return
+	}
+	abort_err = nil
+	for _, member := range members[kept:] {
+		if member.header_offset >= anchor.end_offset {
+			member.header_offset += shift
+			member.body_offset += shift
+			member.end_offset += shift
+			reindexed = append(reindexed, member)
+		}
+	}
+	return reindexed, archive_end + shift, nil
+}
+
+func rewrite_tail(tarfile *os.File, tail_offset int64, header *tar.Header, source_path string, tail []byte, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (abort_err error) {
+	// Writes the new member at tail_offset, followed by the (unaligned) members of the tail end of the archive.
+	region_start := tail_offset - tail_offset%layout.alignment
+	scratch, abort_err := compose_region(tarfile, region_start, tail_offset, header, source_path, tail, layout, archive_progress)
+	if abort_err != nil {
+		return
+	}
+	defer scratch.Close()
+	if abort_err = finalize_tar(scratch); abort_err != nil {
+		return
+	}
+	file_end, abort_err := tarfile.Seek(0, io.SeekEnd)
+	if abort_err != nil {
+		return errorDuringOp{Path: tarfile.Name(), Op: "seek()", Err: abort_err}
+	}
+	return splice_region(tarfile, scratch, region_start, file_end, nil, archive_progress)
+}
+
+func replace_in_place(tarfile *os.File, replacee *archiveMember, header *tar.Header, source_path string, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (strategy string, anchor *archiveMember, abort_err error) {
+	// Much like deleting in place, but now the aligned region from the replacee up to the body of the anchor is
+	// first composed anew in a scratch file. Then the archive is grown (FALLOC_FL_INSERT_RANGE) or shrunk
+	// (FALLOC_FL_COLLAPSE_RANGE) by multiples of the alignment to make the new region fit, and the region is cloned into place.
+	anchor, moved_bytes, _, abort_err := find_anchor(tarfile, replacee.end_offset, layout)
+	if abort_err != nil {
+		return
+	}
+	if moved_bytes > splice_max_moved {
+		return strategy, anchor, errCannotSplice
+	}
+	moved_members := make([]byte, moved_bytes)
+	if _, abort_err = tarfile.ReadAt(moved_members, replacee.end_offset); abort_err != nil {
+		return strategy, anchor, errorDuringOp{Path: tarfile.Name(), Op: "reading", Err: abort_err}
+	}
+	if anchor == nil {
+		// Nothing aligned comes after it, so we can simply rewrite the tail end of the archive.
+		return "truncated", nil, rewrite_tail(tarfile, replacee.header_offset, header, source_path, moved_members, layout, archive_progress)
+	}
+
+	region_start := replacee.header_offset - replacee.header_offset%layout.alignment
+	scratch, abort_err := compose_region(tarfile, region_start, replacee.header_offset, header, source_path, moved_members, layout, archive_progress)
+	if abort_err != nil {
+		return
+	}
+	defer scratch.Close()
+	anchor_header_buf, abort_err := repad_header(anchor.header, tell(scratch), layout)
+	if abort_err != nil {
+		return
+	}
+	if _, abort_err = anchor_header_buf.WriteTo(scratch); abort_err != nil {
+		return strategy, anchor, errorDuringOp{Path: scratch.Name(), Op: "writing", Err: abort_err}
+	}
+	new_length := tell(scratch)
+	if new_length%layout.alignment != 0 {
+		return strategy, anchor, errCannotSplice
+	}
+	switch size_change := new_length - (anchor.body_offset - region_start); {
+	case size_change > 0:
+		strategy = "inserted"
+	case size_change < 0:
+		strategy = "collapsed"
+	default:
+		strategy = "overwritten"
+	}
+	return strategy, anchor, splice_region(tarfile, scratch, region_start, anchor.body_offset, anchor, archive_progress)
+}
+
+func compose_region(tarfile *os.File, region_start int64, member_offset int64, header *tar.Header, source_path string, moved_members []byte, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (scratch *os.File, abort_err error) {
+	// Composes what's to take the place of the archive from region_start onwards in a scratch file: what's there up to
+	// member_offset, the new member (if any), and the members after the old one. Trouble with the file being archived
+	// thus leaves the archive alone.
+	if scratch, abort_err = os.CreateTemp(filepath.Dir(tarfile.Name()), ".deduptar-*"); abort_err != nil {
+		return
+	}
+	os.Remove(scratch.Name())
+	defer func() {
+		if abort_err != nil {
+			scratch.Close()
+		}
+	}()
+	// Offsets in the scratch file are congruent (modulo the alignment) to those in the archive, so that header padding works out.
+	if _, abort_err = io.Copy(scratch, io.NewSectionReader(tarfile, region_start, member_offset-region_start)); abort_err != nil {
+		return scratch, errorDuringOp{Path: scratch.Name(), Op: "writing", Err: abort_err}
+	}
+	if header != nil {
+		if _, abort_err = tarwrite(scratch, header, source_path, layout, false, archive_progress); abort_err != nil {
+			return
+		}
+	}
+	if _, abort_err = scratch.Write(moved_members); abort_err != nil {
+		return scratch, errorDuringOp{Path: scratch.Name(), Op: "writing", Err: abort_err}
+	}
+	return
+}
+
+func splice_region(tarfile *os.File, scratch *os.File, region_start int64, region_end int64, anchor *archiveMember, archive_progress *(chan ProgressMessage)) (abort_err error) {
+	// Puts the region composed in scratch in the place of the archive's region_start up to region_end. That's the end
+	// of the file if there's no anchor; otherwise, it's the anchor's body, which is moved along by as much as the region
+	// grows or shrinks. Until it's done, the old region is kept in a backup file, so that the archive can be restored
+	// should that fail, or be interrupted.
+	new_length, abort_err := scratch.Seek(0, io.SeekEnd)
+	if abort_err != nil {
+		return errorDuringOp{Path: scratch.Name(), Op: "seek()", Err: abort_err}
+	}
+	backup, abort_err := os.CreateTemp(filepath.Dir(tarfile.Name()), ".deduptar-*")
+	if abort_err != nil {
+		return
+	}
+	os.Remove(backup.Name())
+	defer backup.Close()
+	if abort_err = clone_or_copy_range(tarfile, region_start, backup, 0, region_end-region_start, archive_progress); abort_err != nil {
+		return
+	}
+	size_change := new_length - (region_end - region_start)
+	shifted := false
+	restore := func() {
+		if anchor == nil {
+			tarfile.Truncate(region_start)
+		} else if shifted && size_change > 0 {
+			unix.Fallocate(int(tarfile.Fd()), unix.FALLOC_FL_COLLAPSE_RANGE, region_end, size_change)
+		} else if shifted {
+			unix.Fallocate(int(tarfile.Fd()), unix.FALLOC_FL_INSERT_RANGE, region_start+new_length, -size_change)
+		}
+		clone_or_copy_range(backup, 0, tarfile, region_start, region_end-region_start, archive_progress)
+	}
+	undo_on_interrupt(tarfile, restore)
+	defer forget_undo(tarfile)
+	// Interrupt() waits for the region to be put in place, or restored
+	undo_lock.Lock()
+	defer undo_lock.Unlock()
+	switch {
+	case anchor == nil:
+		if abort_err = tarfile.Truncate(region_start); abort_err != nil {
+			abort_err = errorDuringOp{Path: tarfile.Name(), Op: "ftruncate()", Err: abort_err}
+		}
+	case size_change > 0:
+		if abort_err = unix.Fallocate(int(tarfile.Fd()), unix.FALLOC_FL_INSERT_RANGE, region_end, size_change); abort_err != nil {
+			return fmt.Errorf("%w: %w", errCannotSplice, errorDuringOp{Path: tarfile.Name(), Op: "fallocate(FALLOC_FL_INSERT_RANGE)", Err: abort_err})
+		}
+	case size_change < 0:
+		if abort_err = unix.Fallocate(int(tarfile.Fd()), unix.FALLOC_FL_COLLAPSE_RANGE, region_start+new_length, -size_change); abort_err != nil {
+			return fmt.Errorf("%w: %w", errCannotSplice, errorDuringOp{Path: tarfile.Name(), Op: "fallocate(FALLOC_FL_COLLAPSE_RANGE)", Err: abort_err})
+		}
+	}
+	shifted = true
+	if abort_err == nil {
+		abort_err = clone_or_copy_range(scratch, 0, tarfile, region_start, new_length, archive_progress)
+	}
+	if abort_err != nil {
+		restore()
+	}
+	return
+}
+
+func clone_or_copy_range(srcfile *os.File, src_offset int64, dstfile *os.File, dst_offset int64, length int64, archive_progress *(chan ProgressMessage)) error {
+	was_cloned, abort_err := clone_range(int(srcfile.Fd()), src_offset, length, int(dstfile.Fd()), dst_offset, dstfile.Name(), archive_progress)
+	if abort_err != nil || was_cloned {
+		return abort_err
+	}
+	return copy_range(int(srcfile.Fd()), src_offset, length, int(dstfile.Fd()), dst_offset, dstfile.Name(), archive_progress)
+}
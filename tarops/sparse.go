@@ -0,0 +1,339 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Stands in for the GNU.sparse.* PAX records while the header is composed, as archive/tar won't write those.
+	sparse_placeholder_key = "DEDUPTAR.sparse"
+	sparse_extract_bufsize = 256 * FS_PAGESIZE
+)
+
+type sparseExtent struct {
+	offset int64
+	length int64
+}
+
+func data_extents(infile *os.File, size int64) (extents []sparseExtent, has_holes bool, abort_err error) {
+	// Finds the data of the file with SEEK_DATA and SEEK_HOLE. Filesystems that don't keep track of holes report
+	// the whole file as data.
+	fd := int(infile.Fd())
+	for offset := int64(0); offset < size; {
+		data_start, seek_err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(seek_err, unix.ENXIO) {
+			break // only a hole left
+		} else if seek_err != nil {
+			return nil, false, errorDuringOp{Path: infile.Name(), Op: "lseek(SEEK_DATA)", Err: seek_err}
+		}
+		data_end, seek_err := unix.Seek(fd, data_start, unix.SEEK_HOLE)
+		if seek_err != nil {
+			return nil, false, errorDuringOp{Path: infile.Name(), Op: "lseek(SEEK_HOLE)", Err: seek_err}
+		}
+		// The file may have grown since it was stat()ed
+		data_end = min(data_end, size)
+		if data_start >= data_end {
+			break
+		}
+		extents = append(extents, sparseExtent{offset: data_start, length: data_end - data_start})
+		offset = data_end
+	}
+	has_holes = len(extents) != 1 || extents[0].offset != 0 || extents[0].length != size
+	if has_holes && (len(extents) == 0 || extents[len(extents)-1].offset+extents[len(extents)-1].length < size) {
+		// Like GNU tar does, mark the end of a file that ends in a hole with an empty fragment
+		extents = append(extents, sparseExtent{offset: size, length: 0})
+	}
+	return
+}
+
+func format_sparse_map(extents []sparseExtent) []byte {
+	// The PAX 1.0 sparse map: the number of fragments, then the offset and length of each, in decimal on lines of
+	// their own, padded to a tar block.
+	var sparse_map bytes.Buffer
+	fmt.Fprintf(&sparse_map, "%d\n", len(extents))
+	for _, extent := range extents {
+		fmt.Fprintf(&sparse_map, "%d\n%d\n", extent.offset, extent.length)
+	}
+	if overboundary := sparse_map.Len() % TAR_BLOCKSIZE; overboundary > 0 {
+		sparse_map.Write(make([]byte, TAR_BLOCKSIZE-overboundary))
+	}
+	return sparse_map.Bytes()
+}
+
+func format_pax_record(key string, value string) string {
+	// "LENGTH KEY=VALUE\n", where LENGTH counts its own digits as well
+	length := len(key) + len(value) + pax_header_overhead
+	length += len(strconv.Itoa(length))
+	record := fmt.Sprintf("%d %s=%s\n", length, key, value)
+	if len(record) != length {
+		record = fmt.Sprintf("%d %s=%s\n", len(record), key, value)
+	}
+	return record
+}
+
+func sparse_placeholder(sparse_records string) (placeholder_record string, padded_records string) {
+	// A placeholder record exactly as long as the records it stands in for. Not every length can be had with a single
+	// record: at 100, say, the length field would need the digit it counts itself. Then the placeholder is made
+	// longer, and the records are padded with a comment to match.
+	value_length := max(0, len(sparse_records)-len(sparse_placeholder_key)-pax_header_overhead-len(strconv.Itoa(len(sparse_records))))
+	for ; ; value_length++ {
+		placeholder_record = format_pax_record(sparse_placeholder_key, strings.Repeat(pax_filler_char, value_length))
+		shortfall := len(placeholder_record) - len(sparse_records)
+		if shortfall == 0 {
+			return placeholder_record, sparse_records
+		} else if shortfall < 0 {
+			continue
+		}
+		// An empty value would have the special meaning of deleting the record, so there has to be some filler.
+		if filler_length := shortfall - len(pax_padding_headerkey) - pax_header_overhead - len(strconv.Itoa(shortfall)); filler_length > 0 {
+			if padding_record := format_pax_record(pax_padding_headerkey, strings.Repeat(pax_filler_char, filler_length)); len(padding_record) == shortfall {
+				return placeholder_record, sparse_records + padding_record
+			}
+		}
+	}
+}
+
+func write_sparse_header(tarfile *os.File, header *tar.Header, sparse_map []byte, data_size int64, infile *os.File, layout *archiveLayout) (can_clone bool, abort_err error) {
+	// Writes the header of a PAX 1.0 sparse member and its sparse map, so that the data fragments, which are up to
+	// the caller, start aligned where that's worth it. header is that of the expanded file.
+	sparse_header := *header
+	sparse_header.PAXRecords = make(map[string]string, len(header.PAXRecords)+1)
+	for key, value := range header.PAXRecords {
+		sparse_header.PAXRecords[key] = value
+	}
+	// Tars that don't know of sparse members extract the body, map and all, under this name.
+	dir, file := path.Split(header.Name)
+	sparse_header.Name = path.Join(dir, "GNUSparseFile.0", file)
+	sparse_header.Size = int64(len(sparse_map)) + data_size
+	sparse_records := format_pax_record("GNU.sparse.major", "1") +
+		format_pax_record("GNU.sparse.minor", "0") +
+		format_pax_record("GNU.sparse.name", header.Name) +
+		format_pax_record("GNU.sparse.realsize", strconv.FormatInt(header.Size, 10))
+	placeholder_record, sparse_records := sparse_placeholder(sparse_records)
+	sparse_header.PAXRecords[sparse_placeholder_key] = placeholder_record[strings.IndexByte(placeholder_record, '=')+1 : len(placeholder_record)-1]
+
+	pos_header := tell(tarfile)
+	var pristine_header_buf bytes.Buffer
+	if abort_err = tar.NewWriter(&pristine_header_buf).WriteHeader(&sparse_header); abort_err != nil {
+		return false, errorDuringOp{Path: header.Name, Op: "WriteHeader", Err: abort_err}
+	}
+	header_buf, header_growth := &pristine_header_buf, 0
+	if growth, padded_header_buf := pad_tarheader(&sparse_header, pos_header+int64(len(sparse_map)), layout.alignment); worth_aligning(layout, growth, data_size) {
+		// Not worth it otherwise, same as for regular members
+		header_buf, header_growth, can_clone = padded_header_buf, growth, layout.alignment%layout.block_size == 0 && !clone_ruled_out(int(infile.Fd()), int(tarfile.Fd()))
+	}
+	if len(placeholder_record) != len(sparse_records) || !bytes.Contains(header_buf.Bytes(), []byte(placeholder_record)) {
+		return false, errorDuringOp{Path: header.Name, Op: "composing sparse header", Err: fmt.Errorf("placeholder record mismatch")}
+	}
+	if _, abort_err = tarfile.Write(bytes.Replace(header_buf.Bytes(), []byte(placeholder_record), []byte(sparse_records), 1)); abort_err != nil {
+		return false, errorDuringOp{Path: tarfile.Name(), Op: "writing", Err: abort_err}
+	}
+	if _, abort_err = tarfile.Write(sparse_map); abort_err != nil {
+		return false, errorDuringOp{Path: tarfile.Name(), Op: "writing", Err: abort_err}
+	}
+	layout.padding_bytes += int64(header_growth)
+	return
+}
+
+func is_pax1_sparse(header *tar.Header) bool {
+	// The sparse format deduptar writes, whose members can be transplanted as they are stored
+	return header.PAXRecords["GNU.sparse.major"] == "1" && header.PAXRecords["GNU.sparse.minor"] == "0"
+}
+
+func raw_member_header(tarfile *os.File, member *archiveMember) (typeflag byte, stored_size int64, block_end int64, abort_err error) {
+	// archive/tar only reports the expanded size of sparse members. The stored size is found in the raw header
+	// blocks instead, in the member's own block, which comes after any extension headers. block_end is where that
+	// block ends.
+	block := make([]byte, TAR_BLOCKSIZE)
+	for pos := member.header_offset; pos < member.body_offset; {
+		if _, read_err := tarfile.ReadAt(block, pos); read_err != nil {
+			return 0, 0, 0, errorDuringOp{Path: tarfile.Name(), Op: "reading", Err: read_err}
+		}
+		size, parse_err := parse_tar_number(block[124:136])
+		if parse_err != nil {
+			return 0, 0, 0, errorDuringOp{Path: member.header.Name, Op: "reading sparse header", Err: parse_err}
+		}
+		pos += TAR_BLOCKSIZE
+		switch block[156] {
+		case tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			// Extension headers of the member
+			pos += round_up(size, TAR_BLOCKSIZE)
+		default:
+			return block[156], size, pos, nil
+		}
+	}
+	return 0, 0, 0, errorDuringOp{Path: member.header.Name, Op: "reading sparse header", Err: fmt.Errorf("no header block")}
+}
+
+func stored_sparse_map(tarfile *os.File, member *archiveMember) (sparse_map []byte, data_size int64, abort_err error) {
+	// archive/tar reads the sparse map of a PAX 1.0 member without handing it out. It starts right after the
+	// member's raw header block, and the stored size covers the map and the fragments.
+	_, size, map_offset, abort_err := raw_member_header(tarfile, member)
+	if abort_err != nil {
+		return
+	}
+	if map_offset > member.body_offset || size < member.body_offset-map_offset {
+		return nil, 0, errorDuringOp{Path: member.header.Name, Op: "reading sparse header", Err: fmt.Errorf("sparse map out of bounds")}
+	}
+	sparse_map = make([]byte, member.body_offset-map_offset)
+	if _, read_err := tarfile.ReadAt(sparse_map, map_offset); read_err != nil {
+		return nil, 0, errorDuringOp{Path: tarfile.Name(), Op: "reading", Err: read_err}
+	}
+	return sparse_map, size - int64(len(sparse_map)), nil
+}
+
+func stored_sparse_end(tarfile *os.File, member *archiveMember) (end_offset int64, abort_err error) {
+	// Where a sparse member ends, going by its stored size rather than by reading through its expanded data. In GNU
+	// tar's old format, that's the size of the fragments, which follow the extension blocks of the sparse map; in the
+	// PAX formats, it's the size of everything after the raw header block.
+	typeflag, size, block_end, abort_err := raw_member_header(tarfile, member)
+	if abort_err != nil {
+		return
+	}
+	if typeflag == tar.TypeGNUSparse {
+		return round_up(member.body_offset+size, TAR_BLOCKSIZE), nil
+	}
+	return round_up(block_end+size, TAR_BLOCKSIZE), nil
+}
+
+func parse_tar_number(field []byte) (int64, error) {
+	// Numeric header fields are octal, or base-256 for large values, as flagged by the high bit.
+	if len(field) > 0 && field[0]&0x80 != 0 {
+		var value int64
+		for i, b := range field {
+			if i == 0 {
+				b &= 0x7f
+			}
+			value = value<<8 | int64(b)
+		}
+		return value, nil
+	}
+	return strconv.ParseInt(strings.Trim(string(field), " \x00"), 8, 64)
+}
+
+func copy_sparse_member(tarfile *os.File, srcfile *os.File, member *archiveMember, header *tar.Header, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (was_cloned bool, abort_err error) {
+	// Transplants a PAX 1.0 sparse member as it's stored: the sparse map, and the data fragments, which are cloned
+	// where they're aligned in the source archive. header is that of the expanded file, as it's to be named.
+	sparse_map, data_size, abort_err := stored_sparse_map(srcfile, member)
+	if abort_err != nil {
+		return
+	}
+	can_clone, abort_err := write_sparse_header(tarfile, header, sparse_map, data_size, srcfile, layout)
+	if abort_err != nil {
+		return
+	}
+	pos := tell(tarfile)
+	clone_length := int64(0)
+	if can_clone && member.body_offset%layout.block_size == 0 {
+		// Only whole blocks can be cloned from the middle of another archive; the remainder is copied.
+		clone_length = data_size - data_size%layout.block_size
+	}
+	if clone_length > 0 {
+		if was_cloned, abort_err = clone_range(int(srcfile.Fd()), member.body_offset, clone_length, int(tarfile.Fd()), pos, srcfile.Name(), archive_progress); abort_err != nil {
+			return
+		}
+		if was_cloned {
+			layout.cloned_bytes += clone_length
+		} else {
+			clone_length = 0
+		}
+	}
+	if abort_err = copy_range(int(srcfile.Fd()), member.body_offset+clone_length, data_size-clone_length, int(tarfile.Fd()), pos+clone_length, srcfile.Name(), archive_progress); abort_err != nil {
+		return
+	}
+	return was_cloned, pad512(tarfile, pos+data_size)
+}
+
+func tarwrite_sparse(tarfile *os.File, header *tar.Header, infile *os.File, extents []sparseExtent, layout *archiveLayout, archive_progress *(chan ProgressMessage)) (was_cloned bool, abort_err error) {
+	// Writes a file with holes as a PAX 1.0 sparse member, as GNU tar does: the body is the sparse map, followed by
+	// only the data fragments. The header is padded so that the fragments start aligned; as filesystems
+	// hand out data in whole blocks, they can then all be cloned.
+	var data_size int64
+	for _, extent := range extents {
+		data_size += extent.length
+	}
+	can_clone, abort_err := write_sparse_header(tarfile, header, format_sparse_map(extents), data_size, infile, layout)
+	if abort_err != nil {
+		return
+	}
+
+	pos := tell(tarfile)
+	for _, extent := range extents {
+		if extent.length == 0 {
+			continue
+		}
+		if can_clone {
+			fragment_cloned, clone_err := clone_range(int(infile.Fd()), extent.offset, extent.length, int(tarfile.Fd()), pos, infile.Name(), archive_progress)
+			if clone_err != nil {
+				return false, clone_err
+			} else if fragment_cloned {
+				was_cloned = true
+				layout.cloned_bytes += extent.length
+				pos += extent.length
+				continue
+			}
+			// Uncloneable; copy this and the remaining fragments
+			can_clone = false
+		}
+		if abort_err = copy_range(int(infile.Fd()), extent.offset, extent.length, int(tarfile.Fd()), pos, infile.Name(), archive_progress); abort_err != nil {
+			return
+		}
+		pos += extent.length
+	}
+	// Only report cloning if all of the data was
+	was_cloned = was_cloned && can_clone
+	return was_cloned, pad512(tarfile, pos)
+}
+
+func extract_sparse(outfile_handle int, body io.Reader, size int64, full_path string) error {
+	// Writes out the expanded data of a sparse member, leaving holes where it has whole pages of zeroes. archive/tar
+	// doesn't hand out the sparse map, it just reads the holes as zeroes.
+	buf := make([]byte, sparse_extract_bufsize)
+	zero_page := make([]byte, FS_PAGESIZE)
+	for offset := int64(0); offset < size; {
+		chunk := buf[:min(int64(len(buf)), size-offset)]
+		if read, read_err := io.ReadFull(body, chunk); read_err != nil {
+			return fmt.Errorf(error_writesize, "reading", full_path, offset+int64(read), size)
+		}
+		is_hole := func(page_start int) bool {
+			page := chunk[page_start:min(page_start+FS_PAGESIZE, len(chunk))]
+			return bytes.Equal(page, zero_page[:len(page)])
+		}
+		for data_start := 0; data_start < len(chunk); data_start += FS_PAGESIZE {
+			if is_hole(data_start) {
+				continue
+			}
+			// Write out the run of pages with data in one go
+			data_end := data_start + FS_PAGESIZE
+			for data_end < len(chunk) && !is_hole(data_end) {
+				data_end += FS_PAGESIZE
+			}
+			data_end = min(data_end, len(chunk))
+			for written := data_start; written < data_end; {
+				n, write_err := unix.Pwrite(outfile_handle, chunk[written:data_end], offset+int64(written))
+				if write_err != nil {
+					return errorDuringOp{Path: full_path, Op: "pwrite()", Err: write_err}
+				}
+				written += n
+			}
+			data_start = data_end // the page there is a hole, or past the end
+		}
+		offset += int64(len(chunk))
+	}
+	// Trailing holes
+	if err := unix.Ftruncate(outfile_handle, size); err != nil {
+		return errorDuringOp{Path: full_path, Op: "ftruncate()", Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+type transferMethod int
+
+const (
+	method_clone transferMethod = iota
+	method_copy_file_range
+	method_readwrite
+)
+
+const (
+	copy_chunksize    = 1024 * 1024 * 1024 // per copy_file_range() call, which copies no more than about 2 GiB at a time anyway
+	readwrite_bufsize = 1024 * 1024
+)
+
+var transfer_method_reports = map[transferMethod]string{
+	method_clone:           "%s: cloning between these filesystems",
+	method_copy_file_range: "%s: can't clone between these filesystems (%v); copying with copy_file_range() instead",
+	method_readwrite:       "%s: can't copy_file_range() between these filesystems (%v); copying with read() and write() instead",
+}
+
+type devicePair struct {
+	src uint64
+	dst uint64
+}
+
+var (
+	// How data gets from one filesystem to another, as found out upon the first transfer between them. Pairs that
+	// aren't in here haven't been tried yet.
+	transfer_methods = make(map[devicePair]transferMethod)
+)
+
+func device_pair(src_fd int, dst_fd int, full_path string) (pair devicePair, abort_err error) {
+	var src_stat, dst_stat unix.Stat_t
+	if abort_err = unix.Fstat(src_fd, &src_stat); abort_err == nil {
+		abort_err = unix.Fstat(dst_fd, &dst_stat)
+	}
+	if abort_err != nil {
+		return pair, errorDuringOp{Path: full_path, Op: "fstat()", Err: abort_err}
+	}
+	return devicePair{src: src_stat.Dev, dst: dst_stat.Dev}, nil
+}
+
+func settle_transfer_method(pair devicePair, method transferMethod, reason error, full_path string, archive_progress *(chan ProgressMessage)) {
+	// Records how data is transferred between a pair of filesystems from now on, and says so.
+	transfer_methods[pair] = method
+	if reason == nil {
+		verbose_message(archive_progress, fmt.Sprintf(transfer_method_reports[method], full_path))
+	} else {
+		verbose_message(archive_progress, fmt.Sprintf(transfer_method_reports[method], full_path, reason))
+	}
+}
+
+func is_unsupported(err error) bool {
+	// Errors that say that the filesystems can't do it at all, as opposed to not for this range or this file
+	return errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.ENOTTY)
+}
+
+func clone_ruled_out(src_fd int, dst_fd int) bool {
+	// Whether the filesystems turned out not to clone between them
+	pair, stat_err := device_pair(src_fd, dst_fd, "")
+	if stat_err != nil {
+		return false
+	}
+	method, is_settled := transfer_methods[pair]
+	return is_settled && method != method_clone
+}
+
+func clone_range(src_fd int, src_offset int64, length int64, dst_fd int, dst_offset int64, full_path string, archive_progress *(chan ProgressMessage)) (was_cloned bool, abort_err error) {
+	// Clones the range if the filesystems allow for it. If they don't, nothing is done, and it's up to the caller to
+	// copy the range instead; also when the range can't be cloned for reasons of its own, such as misalignment, or
+	// one of the files being NOCOW (EINVAL), or when cloning fails otherwise.
+	pair, abort_err := device_pair(src_fd, dst_fd, full_path)
+	if abort_err != nil {
+		return
+	}
+	if method, is_settled := transfer_methods[pair]; is_settled && method != method_clone {
+		return false, nil
+	}
+	ficlonerange := unix.FileCloneRange{
+		Src_fd:      int64(src_fd),
+		Src_offset:  uint64(src_offset),
+		Src_length:  uint64(length),
+		Dest_offset: uint64(dst_offset),
+	}
+	clone_err := unix.IoctlFileCloneRange(dst_fd, &ficlonerange)
+	switch {
+	case clone_err == nil:
+		if _, is_settled := transfer_methods[pair]; !is_settled {
+			settle_transfer_method(pair, method_clone, nil, full_path, archive_progress)
+		}
+		return true, nil
+	case is_unsupported(clone_err):
+		settle_transfer_method(pair, method_copy_file_range, clone_err, full_path, archive_progress)
+		return false, nil
+	default:
+		// Also for errors such as EIO, which don't tell whether the source or the destination is in trouble; copying
+		// the range instead does.
+		return false, nil
+	}
+}
+
+func copy_range(src_fd int, src_offset int64, length int64, dst_fd int, dst_offset int64, full_path string, archive_progress *(chan ProgressMessage)) error {
+	// Copies the range with copy_file_range(), which lets the filesystem take shortcuts (such as server-side copies),
+	// or with plain read() and write() where it can't be used. The kernel copies at most about 2 GiB per call, and may
+	// well copy less than asked for, so it takes as many calls as it takes.
+	pair, abort_err := device_pair(src_fd, dst_fd, full_path)
+	if abort_err != nil {
+		return abort_err
+	}
+	copied := int64(0)
+	for copied < length && transfer_methods[pair] != method_readwrite {
+		src_pos, dst_pos := src_offset+copied, dst_offset+copied
+		written, copy_err := unix.CopyFileRange(src_fd, &src_pos, dst_fd, &dst_pos, int(min(length-copied, copy_chunksize)), 0)
+		if copy_err == nil && written == 0 {
+			// The source ended early, or it's on a filesystem that only pretends to support copy_file_range(), such as
+			// procfs. Either way, read() and write() have the final word.
+			break
+		} else if errors.Is(copy_err, unix.EINTR) {
+			continue
+		} else if is_unsupported(copy_err) {
+			settle_transfer_method(pair, method_readwrite, copy_err, full_path, archive_progress)
+			break
+		} else if errors.Is(copy_err, unix.EINVAL) {
+			break // not for these files, such as when one of them is a special file
+		} else if copy_err != nil {
+			// Such as EIO, which could be either file's. read() and write() tell the source's trouble from the
+			// destination's.
+			break
+		}
+		copied += int64(written)
+	}
+	return readwrite_range(src_fd, src_offset+copied, length-copied, dst_fd, dst_offset+copied, full_path)
+}
+
+func readwrite_range(src_fd int, src_offset int64, length int64, dst_fd int, dst_offset int64, full_path string) error {
+	buf := make([]byte, min(length, readwrite_bufsize))
+	for copied := int64(0); copied < length; {
+		read, read_err := unix.Pread(src_fd, buf[:min(int64(len(buf)), length-copied)], src_offset+copied)
+		if errors.Is(read_err, unix.EINTR) {
+			continue
+		} else if read_err != nil {
+			return sourceError{errorDuringOp{Path: full_path, Op: "pread()", Err: read_err}}
+		} else if read == 0 {
+			return sourceError{fmt.Errorf(error_writesize, "reading", full_path, copied, length)}
+		}
+		for written := 0; written < read; {
+			n, write_err := unix.Pwrite(dst_fd, buf[written:read], dst_offset+copied+int64(written))
+			if errors.Is(write_err, unix.EINTR) {
+				continue
+			} else if write_err != nil {
+				return errorDuringOp{Path: full_path, Op: "pwrite()", Err: write_err}
+			}
+			written += n
+		}
+		copied += int64(read)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// What a transform applies to, as selected with its r, s and h flags
+	transform_names = 1 << iota
+	transform_symlinks
+	transform_hardlinks
+)
+
+type nameTransform struct {
+	pattern     *regexp.Regexp
+	replacement string
+	global      bool
+	occurrence  int // the first match to replace
+	scope       int
+}
+
+func parse_transforms(expressions []string) (transforms []nameTransform, abort_err error) {
+	// Parses GNU tar style --transform expressions: s/REGEX/REPLACEMENT/[FLAGS], several of which may be
+	// separated by ';'. Any character can stand in for the '/'.
+	for _, expression := range expressions {
+		for remaining := expression; len(remaining) > 0; {
+			var transform nameTransform
+			if transform, remaining, abort_err = parse_transform(remaining); abort_err != nil {
+				return nil, errorDuringOp{Path: expression, Op: "parsing transform", Err: abort_err}
+			}
+			transforms = append(transforms, transform)
+		}
+	}
+	return
+}
+
+func parse_transform(expression string) (transform nameTransform, remaining string, err error) {
+	if len(expression) < 2 || expression[0] != 's' {
+		return transform, "", fmt.Errorf("expected s/REGEX/REPLACEMENT/[FLAGS]")
+	}
+	delimiter := expression[1]
+	var parts [2]strings.Builder
+	pos := 2
+	for part := range parts {
+		for ; pos < len(expression) && expression[pos] != delimiter; pos++ {
+			if expression[pos] == '\\' && pos+1 < len(expression) {
+				pos++
+				if part == 0 && expression[pos] == delimiter {
+					// An escaped delimiter in the regex is just that character
+					parts[part].WriteByte(delimiter)
+					continue
+				}
+				parts[part].WriteByte('\\')
+			}
+			parts[part].WriteByte(expression[pos])
+		}
+		if pos >= len(expression) {
+			return transform, "", fmt.Errorf("unterminated expression")
+		}
+		pos++
+	}
+
+	transform.replacement = parts[1].String()
+	transform.occurrence = 1
+	transform.scope = transform_names | transform_symlinks | transform_hardlinks
+	extended, ignore_case := false, false
+	flags, remaining, _ := strings.Cut(expression[pos:], ";")
+	for i := 0; i < len(flags); i++ {
+		switch flag := flags[i]; flag {
+		case 'g':
+			transform.global = true
+		case 'i':
+			ignore_case = true
+		case 'x':
+			extended = true
+		case 'r', 's', 'h':
+			transform.scope |= map[byte]int{'r': transform_names, 's': transform_symlinks, 'h': transform_hardlinks}[flag]
+		case 'R', 'S', 'H':
+			transform.scope &^= map[byte]int{'R': transform_names, 'S': transform_symlinks, 'H': transform_hardlinks}[flag]
+		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			digits_end := i + 1
+			for digits_end < len(flags) && flags[digits_end] >= '0' && flags[digits_end] <= '9' {
+				digits_end++
+			}
+			if transform.occurrence, err = strconv.Atoi(flags[i:digits_end]); err != nil || transform.occurrence == 0 {
+				return transform, "", fmt.Errorf("invalid occurrence number '%s'", flags[i:digits_end])
+			}
+			i = digits_end - 1
+		default:
+			return transform, "", fmt.Errorf("unknown flag '%c'", flag)
+		}
+	}
+
+	pattern := parts[0].String()
+	if !extended {
+		pattern = bre_to_ere(pattern)
+	}
+	if ignore_case {
+		pattern = "(?i)" + pattern
+	}
+	transform.pattern, err = regexp.Compile(pattern)
+	return
+}
+
+func bre_to_ere(bre string) string {
+	// In a POSIX basic regular expression, the grouping, alternation and repetition operators need a backslash,
+	// and are literal characters without one. It's the other way around in the regexp package.
+	var ere strings.Builder
+	for i := 0; i < len(bre); i++ {
+		switch c := bre[i]; {
+		case c == '\\' && i+1 < len(bre):
+			i++
+			if strings.IndexByte("(){}|+?", bre[i]) >= 0 {
+				ere.WriteByte(bre[i])
+			} else {
+				ere.WriteString(bre[i-1 : i+1])
+			}
+		case strings.IndexByte("(){}|+?", c) >= 0:
+			ere.WriteByte('\\')
+			ere.WriteByte(c)
+		case c == '[':
+			// Bracket expressions are the same, except that a backslash is a literal character in them.
+			class_end := i + 1
+			if class_end < len(bre) && bre[class_end] == '^' {
+				class_end++
+			}
+			if class_end < len(bre) && bre[class_end] == ']' {
+				class_end++
+			}
+			if closing := strings.IndexByte(bre[class_end:], ']'); closing >= 0 {
+				class_end += closing
+				ere.WriteString(strings.ReplaceAll(bre[i:class_end], `\`, `\\`))
+				i = class_end - 1
+			} else {
+				ere.WriteString(`\[`)
+			}
+		default:
+			ere.WriteByte(c)
+		}
+	}
+	return ere.String()
+}
+
+func expand_replacement(replacement string, name string, match []int) string {
+	// Like sed: '&' is the whole match, \1 to \9 are the groups, and a backslash makes anything else literal.
+	var expanded strings.Builder
+	for i := 0; i < len(replacement); i++ {
+		switch c := replacement[i]; {
+		case c == '&':
+			expanded.WriteString(name[match[0]:match[1]])
+		case c == '\\' && i+1 < len(replacement):
+			i++
+			if group := int(replacement[i] - '0'); replacement[i] >= '0' && replacement[i] <= '9' {
+				if 2*group+1 < len(match) && match[2*group] >= 0 {
+					expanded.WriteString(name[match[2*group]:match[2*group+1]])
+				}
+			} else {
+				expanded.WriteByte(replacement[i])
+			}
+		default:
+			expanded.WriteByte(c)
+		}
+	}
+	return expanded.String()
+}
+
+func apply_transforms(name string, scope int, transforms []nameTransform) string {
+	// The transforms apply one after the other, each to the outcome of the previous one.
+	for _, transform := range transforms {
+		if transform.scope&scope == 0 {
+			continue
+		}
+		var transformed strings.Builder
+		copied_up_to := 0
+		for i, match := range transform.pattern.FindAllStringSubmatchIndex(name, -1) {
+			if occurrence := i + 1; occurrence < transform.occurrence || (!transform.global && occurrence > transform.occurrence) {
+				continue
+			}
+			transformed.WriteString(name[copied_up_to:match[0]])
+			transformed.WriteString(expand_replacement(transform.replacement, name, match))
+			copied_up_to = match[1]
+		}
+		transformed.WriteString(name[copied_up_to:])
+		name = transformed.String()
+	}
+	return name
+}
@@ -0,0 +1,115 @@
+// © Copyright Deduptar Authors (see CONTRIBUTORS.md)
+package tarops
+
+import (
+	"archive/tar"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const pax_xattr_prefix = "SCHILY.xattr." // as used by GNU tar, BSD tar and star; POSIX ACLs and capabilities are xattrs too
+
+type XattrOptions struct {
+	Xattrs        bool     // archive or restore extended attributes
+	XattrIncludes []string // if not empty, only extended attributes whose names match one of these glob patterns are considered
+	XattrExcludes []string // extended attributes whose names match one of these glob patterns are left alone
+}
+
+func validate_xattr_patterns(options *XattrOptions) error {
+	for _, pattern := range append(append([]string{}, options.XattrIncludes...), options.XattrExcludes...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errorDuringOp{Path: pattern, Op: "parsing xattr pattern", Err: err}
+		}
+	}
+	return nil
+}
+
+func xattr_is_selected(name string, options *XattrOptions) bool {
+	matches_any := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(options.XattrIncludes) == 0 || matches_any(options.XattrIncludes)) && !matches_any(options.XattrExcludes)
+}
+
+func record_xattrs(header *tar.Header, inpath string, follow_symlinks bool, options *XattrOptions) error {
+	// Stores the (selected) extended attributes of the file as PAX records.
+	listxattr, getxattr := unix.Llistxattr, unix.Lgetxattr
+	if follow_symlinks {
+		listxattr, getxattr = unix.Listxattr, unix.Getxattr
+	}
+	names_buf, err := read_sized(func(buf []byte) (int, error) { return listxattr(inpath, buf) })
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil
+	} else if err != nil {
+		return errorDuringOp{Path: inpath, Op: "listxattr()", Err: err}
+	}
+	names := strings.Split(strings.TrimSuffix(string(names_buf), "\x00"), "\x00")
+	sort.Strings(names)
+	for _, name := range names {
+		if len(name) == 0 || !xattr_is_selected(name, options) {
+			continue
+		}
+		value, err := read_sized(func(buf []byte) (int, error) { return getxattr(inpath, name, buf) })
+		if errors.Is(err, unix.ENODATA) {
+			continue // removed in the meantime
+		} else if err != nil {
+			return errorDuringOp{Path: inpath, Op: "getxattr(" + name + ")", Err: err}
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[pax_xattr_prefix+name] = string(value)
+	}
+	return nil
+}
+
+func read_sized(get func(buf []byte) (int, error)) ([]byte, error) {
+	// For the *xattr() calls, which tell how large a buffer they need when given an empty one. The size may
+	// change in between calls though, hence the retrying.
+	for {
+		size, err := get(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = get(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		return buf[:size], err
+	}
+}
+
+func restore_xattrs(fd int, full_path string, header *tar.Header, options *XattrOptions) (abort_err error) {
+	// Applies the extended attributes recorded for the member, through fd, or for symlinks (which we have no fd for),
+	// through full_path. Setting them all is attempted; the first error is returned.
+	names := make([]string, 0)
+	for key := range header.PAXRecords {
+		if name, is_xattr := strings.CutPrefix(key, pax_xattr_prefix); is_xattr && xattr_is_selected(name, options) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := []byte(header.PAXRecords[pax_xattr_prefix+name])
+		var set_err error
+		if header.Typeflag == tar.TypeSymlink {
+			set_err = unix.Lsetxattr(full_path, name, value, 0)
+		} else {
+			set_err = unix.Fsetxattr(fd, name, value, 0)
+		}
+		if set_err != nil && abort_err == nil {
+			abort_err = unrestoredMetadata{Path: full_path, What: "extended attribute " + name, Err: set_err}
+		}
+	}
+	return
+}